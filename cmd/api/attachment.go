@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kickbu2towski/brb-api/internal/blob"
+	"github.com/kickbu2towski/brb-api/internal/data"
+	"gopkg.in/guregu/null.v4"
+)
+
+const (
+	thumbnailSize = 320
+	// images with more pixels than this are stored without a thumbnail
+	maxThumbnailSourcePixels = 40_000_000
+)
+
+func (app *application) uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	maxSize := app.config.attachments.maxSize
+
+	// leave room for the multipart headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("file must not be larger than %d bytes", maxSize))
+			return
+		}
+		app.badRequestResponse(w, r, "body must be a multipart form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		app.badRequestResponse(w, r, "missing required form field: file")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxSize {
+		app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("file must not be larger than %d bytes", maxSize))
+		return
+	}
+
+	// the mime type is sniffed from the content, the client supplied one isn't trusted
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		app.badRequestResponse(w, r, "file must not be empty")
+		return
+	}
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !Includes(app.config.attachments.allowedTypes, mimeType) {
+		app.badRequestResponse(w, r, fmt.Sprintf("file type %s is not allowed", mimeType))
+		return
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	id, err := data.NewID()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+	a := &data.Attachment{
+		ID:         id,
+		UserID:     user.ID,
+		Filename:   filepath.Base(header.Filename),
+		MimeType:   mimeType,
+		Size:       header.Size,
+		StorageKey: "attachments/" + id,
+	}
+
+	err = app.blobs.Put(ctx, a.StorageKey, file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if strings.HasPrefix(mimeType, "image/") {
+		err = app.processImage(ctx, a, file)
+		if err != nil {
+			app.logError(r, fmt.Errorf("processing image attachment %s: %w", a.ID, err))
+		}
+	}
+
+	err = app.models.Attachments.Insert(ctx, a)
+	if err != nil {
+		// nothing refers to the stored files without the row, so they're removed right away
+		keys := []string{a.StorageKey}
+		if a.ThumbnailKey.Valid {
+			keys = append(keys, a.ThumbnailKey.String)
+		}
+		for _, key := range keys {
+			delErr := app.blobs.Delete(ctx, key)
+			if delErr != nil && !errors.Is(delErr, blob.ErrNotFound) {
+				app.logError(r, fmt.Errorf("deleting attachment file %s: %w", key, delErr))
+			}
+		}
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	a.HasThumbnail = a.ThumbnailKey.Valid
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"attachment": a}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// processImage records the image dimensions and stores a thumbnail of it
+func (app *application) processImage(ctx context.Context, a *data.Attachment, file io.ReadSeeker) error {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+	a.Width = null.IntFrom(int64(cfg.Width))
+	a.Height = null.IntFrom(int64(cfg.Height))
+
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, thumbnail(img, thumbnailSize), &jpeg.Options{Quality: 80})
+	if err != nil {
+		return err
+	}
+
+	key := "thumbnails/" + a.ID
+	err = app.blobs.Put(ctx, key, &buf)
+	if err != nil {
+		return err
+	}
+	a.ThumbnailKey = null.StringFrom(key)
+
+	return nil
+}
+
+// thumbnail scales the image down to fit in a size x size square, flattened on a white background
+func thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/b.Dx()
+		} else {
+			w, h = w*size/b.Dy(), size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			scaled.Set(x, y, src.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h))
+		}
+	}
+
+	dst := image.NewRGBA(scaled.Bounds())
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), scaled, image.Point{}, draw.Over)
+	return dst
+}
+
+func (app *application) getAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	a, ok := app.getAttachmentForUser(w, r)
+	if !ok {
+		return
+	}
+
+	disposition := "attachment"
+	if strings.HasPrefix(a.MimeType, "image/") {
+		disposition = "inline"
+	}
+	headers := http.Header{
+		"Content-Type":        []string{a.MimeType},
+		"Content-Disposition": []string{mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename})},
+	}
+	app.serveBlob(w, r, a.StorageKey, headers)
+}
+
+func (app *application) getAttachmentThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	a, ok := app.getAttachmentForUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !a.ThumbnailKey.Valid {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.serveBlob(w, r, a.ThumbnailKey.String, http.Header{"Content-Type": []string{"image/jpeg"}})
+}
+
+// getAttachmentForUser returns the attachment when the user uploaded it or can read the
+// message it was sent with, otherwise it writes the error response
+func (app *application) getAttachmentForUser(w http.ResponseWriter, r *http.Request) (*data.Attachment, bool) {
+	ctx := context.Background()
+	params := httprouter.ParamsFromContext(r.Context())
+
+	a, err := app.models.Attachments.Get(ctx, params.ByName("attachmentID"))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	user := app.getUserContext(r)
+	if a.UserID == user.ID {
+		return a, true
+	}
+
+	if !a.MessageID.Valid {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	msg, err := app.models.Messages.GetMessage(ctx, a.MessageID.String, -1)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	dm, err := app.models.DMs.GetDM(ctx, msg.DmID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	// attachments of a message deleted for everyone are gone for everyone but the uploader
+	if msg.IsDeleted || !app.policy.CanReadMessage(dm, msg, user.ID) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return a, true
+}
+
+func (app *application) serveBlob(w http.ResponseWriter, r *http.Request, key string, headers http.Header) {
+	rc, err := app.blobs.Get(context.Background(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, blob.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer rc.Close()
+
+	for k, v := range headers {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
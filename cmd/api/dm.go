@@ -2,34 +2,54 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/kickbu2towski/brb-api/internal/data"
 )
 
-// createDMHandler creates the dm if not exists and returs the dm ID
+// createDMHandler creates the dm if not exists and returs the dm ID. when the participants
+// aren't friends the dm is a message request from the logged in user instead.
+// when a name is given a group dm owned by the logged in user is created instead
 func (app *application) createDMHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	var input struct {
-		Participants []int `json:"participants"`
+		Participants []int   `json:"participants"`
+		Name         *string `json:"name"`
 	}
 
-	err := app.readJSON(r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err.Error())
 		return
 	}
 
+	if input.Name != nil {
+		app.createGroupDM(w, r, *input.Name, input.Participants)
+		return
+	}
+
 	if len(input.Participants) != 2 {
 		app.badRequestResponse(w, r, "incorrect participants length")
 		return
 	}
 
+	user := app.getUserContext(r)
+	if !Includes(input.Participants, user.ID) || input.Participants[0] == input.Participants[1] {
+		app.badRequestResponse(w, r, "participants should be the logged in user and the recipient")
+		return
+	}
+
 	isFriends, err := app.models.Users.IsFriends(ctx, input.Participants)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 	if !isFriends {
-		app.badRequestResponse(w, r, "participants should be friends")
+		app.createMessageRequest(w, r, input.Participants)
 		return
 	}
 
@@ -39,8 +59,466 @@ func (app *application) createDMHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// a request from before the users became friends no longer applies
+	err = app.models.DMs.ClearRequest(ctx, input.Participants[0], input.Participants[1])
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"dm_id": dmID}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) createMessageRequest(w http.ResponseWriter, r *http.Request, participants []int) {
+	ctx := context.Background()
+	user := app.getUserContext(r)
+
+	recipientID := participants[0]
+	if recipientID == user.ID {
+		recipientID = participants[1]
+	}
+
+	canRequest, err := app.models.Users.CanRequest(ctx, user.ID, recipientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.badRequestResponse(w, r, "recipient does not exist")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !canRequest {
+		app.errorResponse(w, r, http.StatusForbidden, data.ErrRequestNotAllowed.Error())
+		return
+	}
+
+	dmID, status, err := app.models.DMs.CreateRequest(ctx, user.ID, recipientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRequestDeclined):
+			app.errorResponse(w, r, http.StatusForbidden, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"dm_id": dmID, "request_status": status}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createGroupDM(w http.ResponseWriter, r *http.Request, name string, participants []int) {
+	ctx := context.Background()
+	user := app.getUserContext(r)
+
+	if name == "" {
+		app.badRequestResponse(w, r, "group name must not be empty")
+		return
+	}
+
+	members := make([]int, 0, len(participants))
+	for _, p := range participants {
+		if p == user.ID || Includes(members, p) {
+			continue
+		}
+		isFriends, err := app.models.Users.IsFriends(ctx, []int{user.ID, p})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !isFriends {
+			app.badRequestResponse(w, r, "participants should be friends of the group owner")
+			return
+		}
+		members = append(members, p)
+	}
+
+	if len(members) == 0 {
+		app.badRequestResponse(w, r, "group must have at least one other participant")
+		return
+	}
+
+	dmID, err := app.models.DMs.CreateGroup(ctx, name, user.ID, members)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	dm, err := app.models.DMs.GetDM(ctx, dmID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.publishSystemMessage(ctx, dm, user.ID, fmt.Sprintf("%s created the group %s", user.Username, name))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"dm_id": dmID, "dm": dm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addDMMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	dmID, err := app.readIntParam(r, "dmID")
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	var input struct {
+		UserID int `json:"user_id"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	dm, ok := app.getGroupDM(w, r, dmID)
+	if !ok {
+		return
+	}
+
+	inviter := app.getUserContext(r)
+	canPost, err := app.policy.CanPostToDM(ctx, dm, inviter.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !canPost {
+		app.forbiddenResponse(w, r)
+		return
+	}
+
+	isFriends, err := app.models.Users.IsFriends(ctx, []int{inviter.ID, input.UserID})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !isFriends {
+		app.badRequestResponse(w, r, "added user should be a friend of the inviter")
+		return
+	}
+
+	member, err := app.models.Users.GetUser(ctx, strconv.Itoa(input.UserID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.DMs.AddParticipant(ctx, dmID, input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAlreadyParticipant):
+			app.badRequestResponse(w, r, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	dm.Participants = append(dm.Participants, member)
+
+	by := data.BasicUserResp{ID: inviter.ID, Username: inviter.Username, Avatar: inviter.Avatar}
+	err = app.publishSystemMessage(ctx, dm, inviter.ID, fmt.Sprintf("%s added %s", inviter.Username, member.Username))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.hub.publish(data.EventMemberAdded, data.MemberPayload{DmID: dmID, User: *member, By: by}, dm.ParticipantIDs()...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"dm": dm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeDMMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	dmID, err := app.readIntParam(r, "dmID")
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	userID, err := app.readIntParam(r, "userID")
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	dm, ok := app.getGroupDM(w, r, dmID)
+	if !ok {
+		return
+	}
+
+	user := app.getUserContext(r)
+	if !app.policy.CanRemoveMember(dm, user.ID, userID) {
+		app.forbiddenResponse(w, r)
+		return
+	}
+
+	if int(dm.OwnerID.Int64) == userID {
+		app.badRequestResponse(w, r, "the group owner cannot leave the group")
+		return
+	}
+
+	var member *data.BasicUserResp
+	for _, p := range dm.Participants {
+		if p.ID == userID {
+			member = p
+			break
+		}
+	}
+	if member == nil {
+		app.badRequestResponse(w, r, data.ErrNotParticipant.Error())
+		return
+	}
+
+	err = app.models.DMs.RemoveParticipant(ctx, dmID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotParticipant):
+			app.badRequestResponse(w, r, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the removed member still gets the system message and the event
+	content := fmt.Sprintf("%s removed %s", user.Username, member.Username)
+	if userID == user.ID {
+		content = fmt.Sprintf("%s left the group", user.Username)
+	}
+	err = app.publishSystemMessage(ctx, dm, user.ID, content)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	by := data.BasicUserResp{ID: user.ID, Username: user.Username, Avatar: user.Avatar}
+	app.hub.publish(data.EventMemberRemoved, data.MemberPayload{DmID: dmID, User: *member, By: by}, dm.ParticipantIDs()...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "removed member successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) markDMReadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	var input struct {
+		MessageID string `json:"message_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	dm, ok := app.getDMForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.getUserContext(r)
+	msg, err := app.models.Messages.GetMessage(ctx, input.MessageID, -1)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err != nil || msg.DmID != dm.ID {
+		app.badRequestResponse(w, r, "invalid message_id")
+		return
+	}
+
+	err = app.models.DMs.MarkRead(ctx, dm.ID, user.ID, input.MessageID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	receipt, err := app.hub.publishReadReceipt(ctx, dm, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.hub.publishUnreadCounts(ctx, dm.ID, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"receipt": receipt}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getDMPinsHandler(w http.ResponseWriter, r *http.Request) {
+	dm, ok := app.getDMForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	pins, err := app.models.Pins.GetPins(context.Background(), dm.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"pins": pins}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateDMRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	var input struct {
+		Retention data.Retention `json:"retention"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	if !input.Retention.Valid() {
+		app.badRequestResponse(w, r, data.ErrInvalidRetention.Error())
+		return
+	}
+
+	dm, ok := app.getDMForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.getUserContext(r)
+	canPost, err := app.policy.CanPostToDM(ctx, dm, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !canPost {
+		app.forbiddenResponse(w, r)
+		return
+	}
+
+	if input.Retention == dm.Retention {
+		err = app.writeJSON(w, http.StatusOK, envelope{"dm": dm}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.DMs.SetRetention(ctx, dm.ID, input.Retention)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	dm.Retention = input.Retention
+
+	content := fmt.Sprintf("%s set disappearing messages to %s", user.Username, input.Retention)
+	if input.Retention == data.RetentionOff {
+		content = fmt.Sprintf("%s turned off disappearing messages", user.Username)
+	}
+	err = app.publishSystemMessage(ctx, dm, user.ID, content)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	by := data.BasicUserResp{ID: user.ID, Username: user.Username, Avatar: user.Avatar}
+	app.hub.publish(data.EventRetentionChanged, data.RetentionPayload{DmID: dm.ID, Retention: dm.Retention, By: by}, dm.ParticipantIDs()...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"dm": dm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getDMForParticipant returns the dm named by the dmID param when the logged in user is
+// a participant, otherwise it writes the error response
+func (app *application) getDMForParticipant(w http.ResponseWriter, r *http.Request) (*data.DM, bool) {
+	dmID, err := app.readIntParam(r, "dmID")
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return nil, false
+	}
+
+	return app.getReadableDM(w, r, dmID)
+}
+
+// getReadableDM returns the dm when the logged in user can read it, otherwise it writes
+// the error response
+func (app *application) getReadableDM(w http.ResponseWriter, r *http.Request, dmID int) (*data.DM, bool) {
+	dm, err := app.models.DMs.GetDM(context.Background(), dmID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	user := app.getUserContext(r)
+	if !app.policy.CanReadDM(dm, user.ID) {
+		app.forbiddenResponse(w, r)
+		return nil, false
+	}
+
+	return dm, true
+}
+
+// getGroupDM fetches the dm and writes the error response when it doesn't exist or isn't a group
+func (app *application) getGroupDM(w http.ResponseWriter, r *http.Request, dmID int) (*data.DM, bool) {
+	dm, err := app.models.DMs.GetDM(context.Background(), dmID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !dm.IsGroup {
+		app.badRequestResponse(w, r, "the dm is not a group")
+		return nil, false
+	}
+
+	return dm, true
+}
+
+// publishSystemMessage saves a system message in the dm and broadcasts it to every participant
+func (app *application) publishSystemMessage(ctx context.Context, dm *data.DM, userID int, content string) error {
+	msgID, err := app.models.Messages.InsertSystemMessage(ctx, dm.ID, userID, content)
+	if err != nil {
+		return err
+	}
+
+	m, err := app.models.Messages.GetMessage(ctx, msgID, -1)
+	if err != nil {
+		return err
+	}
+
+	app.hub.publish("DM", m, dm.ParticipantIDs()...)
+	return app.hub.publishUnreadCounts(ctx, dm.ID, otherParticipants(dm, userID)...)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kickbu2towski/brb-api/internal/blob"
+	"github.com/kickbu2towski/brb-api/internal/data"
+)
+
+// maxEmojiFrames is the number of frames an animated emoji can have
+const maxEmojiFrames = 100
+
+var emojiTypes = []string{"image/png", "image/gif", "image/jpeg"}
+
+func (app *application) uploadEmojiHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	maxSize := app.config.emoji.maxSize
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("file must not be larger than %d bytes", maxSize))
+			return
+		}
+		app.badRequestResponse(w, r, "body must be a multipart form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	name := r.FormValue("name")
+	if !data.ValidEmojiName(name) {
+		app.badRequestResponse(w, r, data.ErrInvalidEmojiName.Error())
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		app.badRequestResponse(w, r, "missing required form field: file")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxSize {
+		app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("file must not be larger than %d bytes", maxSize))
+		return
+	}
+
+	b, err := io.ReadAll(file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	e, err := app.decodeEmojiImage(b)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	e.ID, err = data.NewID()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user := app.getUserContext(r)
+	e.OwnerID = user.ID
+	e.Name = name
+	e.StorageKey = "emoji/" + e.ID
+
+	err = app.blobs.Put(ctx, e.StorageKey, bytes.NewReader(b))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Emoji.Insert(ctx, e)
+	if err != nil {
+		deleteErr := app.blobs.Delete(ctx, e.StorageKey)
+		if deleteErr != nil {
+			app.logError(r, fmt.Errorf("deleting emoji image %s after failed insert: %w", e.StorageKey, deleteErr))
+		}
+		switch {
+		case errors.Is(err, data.ErrInvalidEmojiName), errors.Is(err, data.ErrDuplicateEmojiName), errors.Is(err, data.ErrTooManyEmoji):
+			app.badRequestResponse(w, r, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"emoji": e}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// decodeEmojiImage checks an uploaded emoji image against the configured limits and returns
+// an emoji with the details of the image. the errors are meant for the client
+func (app *application) decodeEmojiImage(b []byte) (*data.CustomEmoji, error) {
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(b))
+	if !Includes(emojiTypes, mimeType) {
+		return nil, fmt.Errorf("file type %s is not allowed, emoji must be png, gif or jpeg images", mimeType)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.New("file is not a valid image")
+	}
+	maxDimension := app.config.emoji.maxDimension
+	if cfg.Width > maxDimension || cfg.Height > maxDimension {
+		return nil, fmt.Errorf("emoji must not be larger than %dx%d pixels", maxDimension, maxDimension)
+	}
+
+	e := &data.CustomEmoji{
+		MimeType: mimeType,
+		Size:     int64(len(b)),
+		Width:    cfg.Width,
+		Height:   cfg.Height,
+	}
+
+	switch mimeType {
+	case "image/gif":
+		g, err := gif.DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.New("file is not a valid image")
+		}
+		if len(g.Image) > maxEmojiFrames {
+			return nil, fmt.Errorf("animated emoji must not have more than %d frames", maxEmojiFrames)
+		}
+		e.Animated = len(g.Image) > 1
+	case "image/png":
+		// animated pngs have an acTL chunk before the image data
+		actl := bytes.Index(b, []byte("acTL"))
+		e.Animated = actl >= 0 && actl < bytes.Index(b, []byte("IDAT"))
+	}
+
+	if e.Animated && !app.config.emoji.allowAnimated {
+		return nil, errors.New("animated emoji are not allowed")
+	}
+
+	return e, nil
+}
+
+// getEmojiListHandler lists the logged in user's custom emoji
+func (app *application) getEmojiListHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+	emoji, err := app.models.Emoji.GetForUser(context.Background(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"emoji": emoji}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getEmojiHandler serves the image of any custom emoji, so messages and reactions using
+// someone else's emoji can be rendered
+func (app *application) getEmojiHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	e, err := app.models.Emoji.Get(context.Background(), params.ByName("emojiID"))
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.serveBlob(w, r, e.StorageKey, http.Header{"Content-Type": []string{e.MimeType}})
+}
+
+func (app *application) updateEmojiHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	user := app.getUserContext(r)
+	e, err := app.models.Emoji.Rename(context.Background(), params.ByName("emojiID"), user.ID, input.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrInvalidEmojiName), errors.Is(err, data.ErrDuplicateEmojiName):
+			app.badRequestResponse(w, r, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"emoji": e}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteEmojiHandler deletes the logged in user's emoji with its image and the reactions
+// made with it. messages using it fall back to showing its :name:
+func (app *application) deleteEmojiHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	params := httprouter.ParamsFromContext(r.Context())
+	user := app.getUserContext(r)
+
+	key, removed, err := app.models.Emoji.Delete(ctx, params.ByName("emojiID"), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.blobs.Delete(ctx, key)
+	if err != nil && !errors.Is(err, blob.ErrNotFound) {
+		app.logError(r, fmt.Errorf("deleting emoji image %s: %w", key, err))
+	}
+
+	dms := make(map[int]*data.DM)
+	for _, p := range removed {
+		dm, ok := dms[p.DmID]
+		if !ok {
+			dm, err = app.models.DMs.GetDM(ctx, p.DmID)
+			if err != nil {
+				app.logError(r, fmt.Errorf("publishing removed emoji reactions of dm %d: %w", p.DmID, err))
+				dm = nil
+			}
+			dms[p.DmID] = dm
+		}
+		if dm == nil {
+			continue
+		}
+		app.hub.publish(data.EventReaction, *p, dm.ParticipantIDs()...)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "deleted emoji successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
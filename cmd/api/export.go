@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kickbu2towski/brb-api/internal/blob"
+	"github.com/kickbu2towski/brb-api/internal/data"
+)
+
+// exportPurgeInterval is how often exports past their retention are deleted
+const exportPurgeInterval = time.Hour
+
+var exportContentTypes = map[string]string{
+	data.ExportJSON: "application/json",
+	data.ExportHTML: "text/html; charset=utf-8",
+	data.ExportText: "text/plain; charset=utf-8",
+}
+
+// exportDMHandler streams the history of the dm in the format query param. dms with more
+// messages than the async threshold are exported in the background instead, and the user
+// is sent a download link once the export is ready. a user can only have a few background
+// exports running at once
+func (app *application) exportDMHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = data.ExportJSON
+	}
+	if !data.ValidExportFormat(format) {
+		app.badRequestResponse(w, r, data.ErrInvalidExportFormat.Error())
+		return
+	}
+
+	dm, ok := app.getDMForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	user := app.getUserContext(r)
+	count, err := app.models.Messages.CountMessages(ctx, dm.ID, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if count > app.config.exports.asyncThreshold {
+		id, err := data.NewID()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		e := &data.Export{
+			ID:         id,
+			UserID:     user.ID,
+			DmID:       dm.ID,
+			Format:     format,
+			StorageKey: "exports/" + id,
+		}
+		inserted, err := app.models.Exports.Insert(ctx, e)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrTooManyExports):
+				app.errorResponse(w, r, http.StatusConflict, err.Error())
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// an export of the dm in the format already in progress is returned as is
+		if inserted {
+			go app.generateExport(e, dm)
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"export": e}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": exportFilename(dm.ID, format)}))
+
+	// the response is already under way when the export fails, so the error can only be logged
+	err = app.writeExport(ctx, w, dm, user.ID, format)
+	if err != nil {
+		app.logError(r, fmt.Errorf("exporting dm %d: %w", dm.ID, err))
+	}
+}
+
+// generateExport writes the export to blob storage and tells the user once it's done
+func (app *application) generateExport(e *data.Export, dm *data.DM) {
+	ctx := context.Background()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(app.writeExport(ctx, pw, dm, e.UserID, e.Format))
+	}()
+	err := app.blobs.Put(ctx, e.StorageKey, pr)
+	// unblocks the writer when storing failed before reading everything
+	pr.CloseWithError(err)
+
+	status := data.ExportReady
+	if err != nil {
+		app.logger.Printf("error: generating export %s: %v", e.ID, err)
+		status = data.ExportFailed
+	}
+
+	err = app.models.Exports.Complete(ctx, e, status)
+	if err != nil {
+		app.logger.Printf("error: completing export %s: %v", e.ID, err)
+		return
+	}
+
+	if e.Status == data.ExportReady {
+		e.DownloadURL = exportDownloadURL(e.ID)
+	}
+	app.hub.publish(data.EventExportCompleted, data.ExportPayload{Export: e}, e.UserID)
+}
+
+func (app *application) getExportHandler(w http.ResponseWriter, r *http.Request) {
+	e, _, ok := app.getExportForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	if e.Status == data.ExportReady {
+		e.DownloadURL = exportDownloadURL(e.ID)
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"export": e}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	e, _, ok := app.getExportForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	if e.Status != data.ExportReady {
+		app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("the export is %s", e.Status))
+		return
+	}
+
+	headers := http.Header{
+		"Content-Type":        []string{exportContentTypes[e.Format]},
+		"Content-Disposition": []string{mime.FormatMediaType("attachment", map[string]string{"filename": exportFilename(e.DmID, e.Format)})},
+	}
+	app.serveBlob(w, r, e.StorageKey, headers)
+}
+
+// getExportForParticipant returns the logged in user's export named by the exportID param
+// and its dm while the user is still a participant, otherwise it writes the error response
+func (app *application) getExportForParticipant(w http.ResponseWriter, r *http.Request) (*data.Export, *data.DM, bool) {
+	ctx := context.Background()
+	params := httprouter.ParamsFromContext(r.Context())
+	user := app.getUserContext(r)
+
+	e, err := app.models.Exports.Get(ctx, params.ByName("exportID"), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil, false
+	}
+
+	dm, err := app.models.DMs.GetDM(ctx, e.DmID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, nil, false
+	}
+
+	if !app.policy.CanReadDM(dm, user.ID) {
+		app.notFoundResponse(w, r)
+		return nil, nil, false
+	}
+
+	return e, dm, true
+}
+
+// purgeExports deletes the exports older than the configured retention along with their files
+func (app *application) purgeExports(ctx context.Context) error {
+	keys, err := app.models.Exports.DeleteBefore(ctx, time.Now().Add(-app.config.exports.retention))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = app.blobs.Delete(ctx, key)
+		if err != nil && !errors.Is(err, blob.ErrNotFound) {
+			app.logger.Printf("error: deleting export %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func exportDownloadURL(id string) string {
+	return "/v1/exports/" + id + "/download"
+}
+
+func exportFilename(dmID int, format string) string {
+	return fmt.Sprintf("dm-%d-export.%s", dmID, format)
+}
+
+// writeExport writes the history of the dm visible to viewerID to w in the format
+func (app *application) writeExport(ctx context.Context, w io.Writer, dm *data.DM, viewerID int, format string) error {
+	bw := bufio.NewWriter(w)
+
+	var ex exporter
+	switch format {
+	case data.ExportHTML:
+		ex = &htmlExporter{w: bw}
+	case data.ExportText:
+		ex = &textExporter{w: bw}
+	default:
+		ex = &jsonExporter{w: bw}
+	}
+
+	err := ex.begin(dm)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Messages.ExportMessages(ctx, dm.ID, viewerID, ex.message)
+	if err != nil {
+		return err
+	}
+
+	err = ex.end()
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// exporter writes a dm's history one message at a time
+type exporter interface {
+	begin(dm *data.DM) error
+	message(m *data.ExportedMessage) error
+	end() error
+}
+
+type jsonExporter struct {
+	w *bufio.Writer
+	n int
+}
+
+func (e *jsonExporter) begin(dm *data.DM) error {
+	b, err := json.Marshal(dm)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.w, `{"dm":%s,"exported_at":"%s","messages":[`, b, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (e *jsonExporter) message(m *data.ExportedMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if e.n > 0 {
+		err = e.w.WriteByte(',')
+		if err != nil {
+			return err
+		}
+	}
+	e.n++
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *jsonExporter) end() error {
+	_, err := e.w.WriteString("]}\n")
+	return err
+}
+
+type textExporter struct {
+	w *bufio.Writer
+}
+
+func (e *textExporter) begin(dm *data.DM) error {
+	_, err := fmt.Fprintf(e.w, "# %s\n# exported at %s\n", exportTitle(dm), exportTime(time.Now()))
+	return err
+}
+
+func (e *textExporter) message(m *data.ExportedMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n[%s] %s", exportTime(m.CreatedAt), m.User.Username)
+	if m.IsEdited {
+		b.WriteString(" (edited)")
+	}
+	content := strings.ReplaceAll(m.Content, "\n", "\n    ")
+	if m.IsDeleted {
+		content = "(message deleted)"
+	}
+	fmt.Fprintf(&b, ": %s\n", content)
+
+	if m.ReplyTo != nil {
+		fmt.Fprintf(&b, "    replying to %s: %s\n", m.ReplyTo.User.Username, m.ReplyTo.Content)
+	}
+	if m.ForwardedFrom != nil {
+		fmt.Fprintf(&b, "    forwarded from %s\n", m.ForwardedFrom.User.Username)
+	}
+	for _, a := range m.Attachments {
+		fmt.Fprintf(&b, "    attachment: %s %s\n", a.Filename, attachmentURL(a.ID))
+	}
+	if len(m.Reactions) > 0 {
+		reactions := make([]string, 0, len(m.Reactions))
+		for _, reaction := range sortedReactions(m.Reactions) {
+			reactions = append(reactions, fmt.Sprintf("%s %d", reaction, len(m.Reactions[reaction])))
+		}
+		fmt.Fprintf(&b, "    reactions: %s\n", strings.Join(reactions, ", "))
+	}
+	for _, rev := range m.Revisions {
+		fmt.Fprintf(&b, "    before edit at %s: %s\n", exportTime(rev.EditedAt), strings.ReplaceAll(rev.Content, "\n", "\n    "))
+	}
+
+	_, err := e.w.WriteString(b.String())
+	return err
+}
+
+func (e *textExporter) end() error {
+	return nil
+}
+
+var exportHTML = template.Must(template.New("export").Funcs(template.FuncMap{
+	"time":       exportTime,
+	"attachment": attachmentURL,
+	"reactions":  sortedReactions,
+}).Parse(`
+{{define "begin"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; }
+.message { margin: 1rem 0; }
+.meta { color: #666; font-size: 0.875rem; }
+.content { white-space: pre-wrap; margin: 0.25rem 0; }
+.deleted { font-style: italic; color: #999; }
+blockquote { margin: 0.25rem 0; padding-left: 0.5rem; border-left: 3px solid #ccc; color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">exported at {{time .ExportedAt}}</p>
+{{end}}
+
+{{define "message"}}<div class="message" id="{{.ID}}">
+<div class="meta"><strong>{{.User.Username}}</strong> {{time .CreatedAt}}{{if .IsEdited}} (edited){{end}}</div>
+{{with .ReplyTo}}<blockquote>replying to <a href="#{{.ID}}">{{.User.Username}}</a>: {{.Content}}</blockquote>{{end}}
+{{with .ForwardedFrom}}<div class="meta">forwarded from {{.User.Username}}</div>{{end}}
+{{if .IsDeleted}}<p class="content deleted">message deleted</p>{{else}}<p class="content">{{.Content}}</p>{{end}}
+{{range .Attachments}}<div>attachment: <a href="{{attachment .ID}}">{{.Filename}}</a></div>{{end}}
+{{if .Reactions}}<div class="meta">{{$reactions := .Reactions}}{{range reactions .Reactions}}{{.}} {{len (index $reactions .)}} {{end}}</div>{{end}}
+{{range .Revisions}}<details><summary class="meta">before edit at {{time .EditedAt}}</summary><p class="content">{{.Content}}</p></details>{{end}}
+</div>
+{{end}}
+
+{{define "end"}}</body>
+</html>
+{{end}}
+`))
+
+type htmlExporter struct {
+	w *bufio.Writer
+}
+
+func (e *htmlExporter) begin(dm *data.DM) error {
+	return exportHTML.ExecuteTemplate(e.w, "begin", map[string]any{
+		"Title":      exportTitle(dm),
+		"ExportedAt": time.Now(),
+	})
+}
+
+func (e *htmlExporter) message(m *data.ExportedMessage) error {
+	return exportHTML.ExecuteTemplate(e.w, "message", m)
+}
+
+func (e *htmlExporter) end() error {
+	return exportHTML.ExecuteTemplate(e.w, "end", nil)
+}
+
+// exportTitle names the dm after its name, or its participants when it has none
+func exportTitle(dm *data.DM) string {
+	if dm.Name.Valid && dm.Name.String != "" {
+		return dm.Name.String
+	}
+	usernames := make([]string, 0, len(dm.Participants))
+	for _, p := range dm.Participants {
+		usernames = append(usernames, p.Username)
+	}
+	return strings.Join(usernames, ", ")
+}
+
+func exportTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+func attachmentURL(id string) string {
+	return "/v1/attachments/" + id
+}
+
+func sortedReactions(reactions map[string][]int) []string {
+	keys := make([]string, 0, len(reactions))
+	for reaction := range reactions {
+		keys = append(keys, reaction)
+	}
+	sort.Strings(keys)
+	return keys
+}
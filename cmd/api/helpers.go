@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
 )
 
 type envelope map[string]any
@@ -28,7 +31,11 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
-func (app *application) readJSON(r *http.Request, dst any) error {
+// maxBodySize is the size in bytes of the largest json body read from a request
+const maxBodySize = 1 << 20
+
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 
@@ -37,6 +44,7 @@ func (app *application) readJSON(r *http.Request, dst any) error {
 		var syntaxError *json.SyntaxError
 		var typeError *json.UnmarshalTypeError
 		var invalidMarshalError *json.InvalidUnmarshalError
+		var maxBytesError *http.MaxBytesError
 
 		switch {
 		case errors.As(err, &syntaxError):
@@ -50,6 +58,8 @@ func (app *application) readJSON(r *http.Request, dst any) error {
 			return fmt.Errorf("body contains incorrect type for a field (at character %d)", typeError.Offset)
 		case errors.Is(err, io.EOF):
 			return fmt.Errorf("body is empty")
+		case errors.As(err, &maxBytesError):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
 		case errors.As(err, &invalidMarshalError):
 			panic("readJSON: incorrect destination when decoding")
 		default:
@@ -58,10 +68,18 @@ func (app *application) readJSON(r *http.Request, dst any) error {
 	}
 
 	/* TODO:
-	   - throw error if the body size exceeds a certain limit (say 1MB)
 	   - throw error if the body contains extra fields that aren't in the input
 		- throw error if the body contains extra values. like this -> '{"name": "kick"} :lol'
 	*/
 
 	return nil
 }
+
+func (app *application) readIntParam(r *http.Request, name string) (int, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName(name))
+	if err != nil {
+		return 0, fmt.Errorf("missing or invalid param: %s", name)
+	}
+	return id, nil
+}
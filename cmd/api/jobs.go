@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kickbu2towski/brb-api/internal/blob"
+	"github.com/kickbu2towski/brb-api/internal/data"
+)
+
+const (
+	// expiredSweepInterval is how often messages past their dm's retention are deleted
+	expiredSweepInterval = time.Minute
+	// expiredSweepBatch is the number of expired messages deleted per transaction
+	expiredSweepBatch = 500
+	// deletedPurgeInterval is how often the content of deleted messages past the grace period is erased
+	deletedPurgeInterval = 10 * time.Minute
+	// deletedPurgeBatch is the number of deleted messages purged per transaction
+	deletedPurgeBatch = 500
+	// unlinkedPurgeInterval is how often attachments never sent with a message are deleted
+	unlinkedPurgeInterval = time.Hour
+	// unlinkedPurgeBatch is the number of unlinked attachments deleted per transaction
+	unlinkedPurgeBatch = 500
+)
+
+// runPeriodically calls fn every interval until the process exits. errors are logged
+// and the job keeps running
+func (app *application) runPeriodically(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := fn(context.Background())
+		if err != nil {
+			app.logger.Printf("error: running job %s: %v", name, err)
+		}
+	}
+}
+
+// revisionPurgeInterval is how often message revisions past their retention are deleted
+const revisionPurgeInterval = time.Hour
+
+// purgeRevisions deletes message revisions older than the configured retention
+func (app *application) purgeRevisions(ctx context.Context) error {
+	n, err := app.models.Messages.DeleteRevisionsBefore(ctx, time.Now().Add(-app.config.revisions.retention))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		app.logger.Printf("purged %d message revisions", n)
+	}
+	return nil
+}
+
+// sweepExpiredMessages hard deletes the messages past their dm's retention along with their
+// attachment files and tells the participants to remove them
+func (app *application) sweepExpiredMessages(ctx context.Context) error {
+	for {
+		expired, keys, err := app.models.Messages.DeleteExpired(ctx, expiredSweepBatch)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = app.blobs.Delete(ctx, key)
+			if err != nil && !errors.Is(err, blob.ErrNotFound) {
+				app.logger.Printf("error: deleting expired attachment %s: %v", key, err)
+			}
+		}
+
+		byDM := make(map[int][]string)
+		for _, e := range expired {
+			byDM[e.DmID] = append(byDM[e.DmID], e.ID)
+		}
+		for dmID, ids := range byDM {
+			dm, err := app.models.DMs.GetDM(ctx, dmID)
+			if err != nil {
+				return err
+			}
+			app.hub.publish(data.EventMessagesExpired, data.MessagesExpiredPayload{DmID: dmID, MessageIDs: ids}, dm.ParticipantIDs()...)
+			err = app.hub.publishUnreadCounts(ctx, dmID, dm.ParticipantIDs()...)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(expired) < expiredSweepBatch {
+			return nil
+		}
+	}
+}
+
+// purgeDeletedMessages erases the content and attachment files of messages deleted longer
+// than the grace period ago, leaving their tombstones
+func (app *application) purgeDeletedMessages(ctx context.Context) error {
+	for {
+		n, keys, err := app.models.Messages.PurgeDeleted(ctx, time.Now().Add(-app.config.messages.deletedPurgeAfter), deletedPurgeBatch)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = app.blobs.Delete(ctx, key)
+			if err != nil && !errors.Is(err, blob.ErrNotFound) {
+				app.logger.Printf("error: deleting purged attachment %s: %v", key, err)
+			}
+		}
+
+		if n < deletedPurgeBatch {
+			return nil
+		}
+	}
+}
+
+// purgeUnlinkedAttachments deletes the attachments uploaded longer than the configured
+// cutoff ago that were never sent with a message, along with their files
+func (app *application) purgeUnlinkedAttachments(ctx context.Context) error {
+	for {
+		n, keys, err := app.models.Attachments.DeleteUnlinkedBefore(ctx, time.Now().Add(-app.config.attachments.unlinkedPurgeAfter), unlinkedPurgeBatch)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = app.blobs.Delete(ctx, key)
+			if err != nil && !errors.Is(err, blob.ErrNotFound) {
+				app.logger.Printf("error: deleting unlinked attachment %s: %v", key, err)
+			}
+		}
+
+		if n < unlinkedPurgeBatch {
+			return nil
+		}
+	}
+}
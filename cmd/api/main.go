@@ -11,7 +11,10 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kickbu2towski/brb-api/internal/blob"
 	"github.com/kickbu2towski/brb-api/internal/data"
+	"github.com/kickbu2towski/brb-api/internal/policy"
+	"github.com/kickbu2towski/brb-api/internal/preview"
 	lksdk "github.com/livekit/server-sdk-go"
 )
 
@@ -20,8 +23,10 @@ type application struct {
 	config    config
 	pool      *pgxpool.Pool
 	models    *data.Models
+	policy    *policy.Policy
 	hub       *Hub
 	lkRoomSvc *lksdk.RoomServiceClient
+	blobs     blob.Store
 }
 
 type config struct {
@@ -41,6 +46,36 @@ type config struct {
 		key    string
 		secret string
 	}
+	messages struct {
+		pageSize          int
+		maxPageSize       int
+		deleteWindow      time.Duration
+		deletedPurgeAfter time.Duration
+	}
+	reactions struct {
+		allowed []string
+	}
+	emoji struct {
+		maxSize       int64
+		maxDimension  int
+		allowAnimated bool
+	}
+	exports struct {
+		asyncThreshold int
+		retention      time.Duration
+	}
+	attachments struct {
+		dir                string
+		maxSize            int64
+		allowedTypes       []string
+		unlinkedPurgeAfter time.Duration
+	}
+	linkPreview struct {
+		timeout time.Duration
+	}
+	revisions struct {
+		retention time.Duration
+	}
 }
 
 func main() {
@@ -54,7 +89,13 @@ func main() {
 		logger.Fatal(err)
 	}
 
+	blobs, err := blob.NewLocalStore(cfg.attachments.dir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
 	models := data.NewModels(pool)
+	accessPolicy := policy.New(&models.Users, &models.DMs)
 	lkRoomSvc := lksdk.NewRoomServiceClient(cfg.livekit.host, cfg.livekit.key, cfg.livekit.secret)
 
 	app := application{
@@ -62,8 +103,10 @@ func main() {
 		config:    cfg,
 		pool:      pool,
 		models:    models,
-		hub:       NewHub(models),
+		policy:    accessPolicy,
+		hub:       NewHub(models, accessPolicy, preview.NewHTTPFetcher(cfg.linkPreview.timeout), cfg.messages.deleteWindow, cfg.reactions.allowed),
 		lkRoomSvc: lkRoomSvc,
+		blobs:     blobs,
 	}
 
 	server := &http.Server{
@@ -74,6 +117,19 @@ func main() {
 	}
 
 	go app.hub.run()
+	go app.runPeriodically("dispatch scheduled messages", scheduledDispatchInterval, app.dispatchScheduledMessages)
+	go app.runPeriodically("sweep expired messages", expiredSweepInterval, app.sweepExpiredMessages)
+	if cfg.messages.deletedPurgeAfter > 0 {
+		go app.runPeriodically("purge deleted messages", deletedPurgeInterval, app.purgeDeletedMessages)
+	}
+	go app.runPeriodically("purge exports", exportPurgeInterval, app.purgeExports)
+	if cfg.attachments.unlinkedPurgeAfter > 0 {
+		go app.runPeriodically("purge unlinked attachments", unlinkedPurgeInterval, app.purgeUnlinkedAttachments)
+	}
+	if cfg.revisions.retention > 0 {
+		go app.runPeriodically("purge revisions", revisionPurgeInterval, app.purgeRevisions)
+	}
+
 	logger.Printf("server starting at port %s", cfg.port)
 	err = server.ListenAndServe()
 	logger.Fatal(err)
@@ -111,6 +167,44 @@ func parseFlags(cfg *config) {
 	flag.StringVar(&cfg.livekit.key, "lk-key", os.Getenv("LK_KEY"), "LiveKit Key")
 	flag.StringVar(&cfg.livekit.secret, "lk-secret", os.Getenv("LK_SECRET"), "LiveKit Secret")
 
+	flag.IntVar(&cfg.messages.pageSize, "messages-page-size", 50, "Default number of messages returned per page")
+	flag.IntVar(&cfg.messages.maxPageSize, "messages-max-page-size", 100, "Maximum number of messages returned per page")
+	flag.DurationVar(&cfg.messages.deleteWindow, "messages-delete-window", 0, "How long after sending messages can be deleted for everyone (0 is no limit)")
+	flag.DurationVar(&cfg.messages.deletedPurgeAfter, "messages-deleted-purge-after", 24*time.Hour, "How long the content of deleted messages is kept before it is erased (0 keeps it forever)")
+
+	flag.StringVar(&cfg.attachments.dir, "attachments-dir", "./uploads", "Directory where uploaded attachments are stored")
+	flag.Int64Var(&cfg.attachments.maxSize, "attachments-max-size", 10<<20, "Maximum attachment size in bytes")
+	flag.DurationVar(&cfg.attachments.unlinkedPurgeAfter, "attachments-unlinked-purge-after", 24*time.Hour, "How long uploaded attachments never sent with a message are kept (0 keeps them forever)")
+
+	flag.Int64Var(&cfg.emoji.maxSize, "emoji-max-size", 256<<10, "Maximum custom emoji size in bytes")
+	flag.IntVar(&cfg.emoji.maxDimension, "emoji-max-dimension", 128, "Maximum custom emoji width and height in pixels")
+	flag.BoolVar(&cfg.emoji.allowAnimated, "emoji-allow-animated", true, "Allow animated custom emoji")
+
+	flag.IntVar(&cfg.exports.asyncThreshold, "export-async-threshold", 5000, "Number of messages above which dm exports are generated in the background")
+	flag.DurationVar(&cfg.exports.retention, "export-retention", 24*time.Hour, "How long background exports can be downloaded")
+
+	flag.DurationVar(&cfg.linkPreview.timeout, "link-preview-timeout", 5*time.Second, "Timeout for fetching link previews")
+
+	flag.DurationVar(&cfg.revisions.retention, "revisions-retention", 90*24*time.Hour, "How long message edit history is kept (0 keeps it forever)")
+
+	cfg.attachments.allowedTypes = []string{
+		"image/jpeg", "image/png", "image/gif", "image/webp",
+		"audio/mpeg", "audio/wave", "audio/ogg", "video/mp4", "video/webm",
+		"application/pdf", "text/plain",
+	}
+	flag.Func("attachments-allowed-types", "A list of allowed attachment mime types", func(s string) error {
+		cfg.attachments.allowedTypes = strings.Split(s, " ")
+		return nil
+	})
+
+	cfg.reactions.allowed = []string{
+		"👍", "👎", "❤️", "😂", "😮", "😢", "😡", "🎉", "🔥", "👀", "🙏", "✅",
+	}
+	flag.Func("reactions-allowed", "A list of emoji messages can be reacted with", func(s string) error {
+		cfg.reactions.allowed = strings.Split(s, " ")
+		return nil
+	})
+
 	cfg.cors.allowedOrigins = []string{"http://localhost:3000"}
 	flag.Func("allowed-origins", "A list of allowed origins", func(s string) error {
 		cfg.cors.allowedOrigins = strings.Split(s, " ")
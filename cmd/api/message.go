@@ -2,25 +2,545 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kickbu2towski/brb-api/internal/data"
+	"github.com/kickbu2towski/brb-api/internal/richtext"
+	"gopkg.in/guregu/null.v4"
 )
 
 func (app *application) getMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
 	dmID, err := strconv.Atoi(r.FormValue("dm_id"))
 	if err != nil {
 		app.badRequestResponse(w, r, "invalid query param: dm_id")
 		return
 	}
 
-	messages, err := app.models.Messages.GetMessages(context.Background(), dmID)
+	_, ok := app.getReadableDM(w, r, dmID)
+	if !ok {
+		return
+	}
+
+	filter := data.MessageFilter{
+		Before:   r.FormValue("before"),
+		After:    r.FormValue("after"),
+		Around:   r.FormValue("around"),
+		PageSize: app.config.messages.pageSize,
+		ViewerID: app.getUserContext(r).ID,
+	}
+
+	if limit := r.FormValue("limit"); limit != "" {
+		filter.PageSize, err = strconv.Atoi(limit)
+		if err != nil || filter.PageSize < 1 || filter.PageSize > app.config.messages.maxPageSize {
+			app.badRequestResponse(w, r, fmt.Sprintf("invalid query param: limit (must be between 1 and %d)", app.config.messages.maxPageSize))
+			return
+		}
+	}
+
+	var cursors int
+	for _, cursor := range []struct{ name, id string }{
+		{"before", filter.Before},
+		{"after", filter.After},
+		{"around", filter.Around},
+	} {
+		if cursor.id == "" {
+			continue
+		}
+		cursors++
+
+		m, err := app.models.Messages.GetMessage(ctx, cursor.id, -1)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if err != nil || m.DmID != dmID {
+			app.badRequestResponse(w, r, "invalid query param: "+cursor.name)
+			return
+		}
+	}
+
+	if cursors > 1 {
+		app.badRequestResponse(w, r, "only one of before, after and around can be used")
+		return
+	}
+
+	page, err := app.models.Messages.GetMessages(ctx, dmID, filter)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+	receipts, err := app.models.DMs.GetReadReceipts(ctx, dmID, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	res := envelope{
+		"messages":       page.Messages,
+		"has_more":       page.HasMore,
+		"has_more_after": page.HasMoreAfter,
+		"read_receipts":  receipts,
+	}
+	err = app.writeJSON(w, http.StatusOK, res, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) searchMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	filter := data.SearchFilter{
+		Query:    r.FormValue("q"),
+		Before:   r.FormValue("before"),
+		PageSize: app.config.messages.pageSize,
+	}
+
+	if filter.Query == "" {
+		app.badRequestResponse(w, r, "invalid query param: q")
+		return
+	}
+
+	var err error
+	for _, param := range []struct {
+		name string
+		dst  *int
+	}{
+		{"dm_id", &filter.DmID},
+		{"sender_id", &filter.SenderID},
+	} {
+		if v := r.FormValue(param.name); v != "" {
+			*param.dst, err = strconv.Atoi(v)
+			if err != nil {
+				app.badRequestResponse(w, r, "invalid query param: "+param.name)
+				return
+			}
+		}
+	}
+
+	for _, param := range []struct {
+		name string
+		dst  *null.Time
+		// inclusive makes a date cover the whole day instead of ending at its start
+		inclusive bool
+	}{
+		{"from", &filter.From, false},
+		{"to", &filter.To, true},
+	} {
+		if v := r.FormValue(param.name); v != "" {
+			t, isDate, err := parseDateParam(v)
+			if err != nil {
+				app.badRequestResponse(w, r, "invalid query param: "+param.name+" (must be a RFC 3339 time or a date)")
+				return
+			}
+			if isDate && param.inclusive {
+				t = t.AddDate(0, 0, 1)
+			}
+			*param.dst = null.TimeFrom(t)
+		}
+	}
+
+	if limit := r.FormValue("limit"); limit != "" {
+		filter.PageSize, err = strconv.Atoi(limit)
+		if err != nil || filter.PageSize < 1 || filter.PageSize > app.config.messages.maxPageSize {
+			app.badRequestResponse(w, r, fmt.Sprintf("invalid query param: limit (must be between 1 and %d)", app.config.messages.maxPageSize))
+			return
+		}
+	}
+
+	user := app.getUserContext(r)
+	results, hasMore, err := app.models.Messages.SearchMessages(context.Background(), user.ID, filter)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": results, "has_more": hasMore}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// parseDateParam parses a RFC 3339 time or a date, reporting whether it was a date
+func parseDateParam(s string) (time.Time, bool, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+		return t, err == nil, err
+	}
+	return t, false, nil
+}
+
+// getMessageHandler returns a single message. httprouter doesn't allow /v1/messages/search
+// next to /v1/messages/:messageID, so search requests are dispatched from here
+func (app *application) getMessageHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	if params.ByName("messageID") == "search" {
+		app.searchMessagesHandler(w, r)
+		return
+	}
+
+	m, _, ok := app.getMessageForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": m}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getMessageHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	m, _, ok := app.getMessageForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	// the history of a deleted message is scrubbed along with its content
+	revisions := make([]*data.MessageRevision, 0)
+	var err error
+	if !m.IsDeleted {
+		revisions, err = app.models.Messages.GetRevisions(context.Background(), m.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": m, "revisions": revisions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getMessageRepliesHandler(w http.ResponseWriter, r *http.Request) {
+	m, _, ok := app.getMessageForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	replies, err := app.models.Messages.GetReplies(context.Background(), m.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"replies": replies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getMessageForParticipant returns the message named by the messageID param and its dm when the
+// logged in user is a participant of the dm, otherwise it writes the error response
+func (app *application) getMessageForParticipant(w http.ResponseWriter, r *http.Request) (*data.MessageResp, *data.DM, bool) {
+	ctx := context.Background()
+	params := httprouter.ParamsFromContext(r.Context())
+
+	m, err := app.models.Messages.GetMessage(ctx, params.ByName("messageID"), -1)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil, false
+	}
+
+	dm, err := app.models.DMs.GetDM(ctx, m.DmID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return nil, nil, false
+	}
+
+	// non participants can't tell whether the message exists
+	user := app.getUserContext(r)
+	if !app.policy.CanReadMessage(dm, m, user.ID) {
+		app.notFoundResponse(w, r)
+		return nil, nil, false
+	}
+
+	return m, dm, true
+}
+
+// createMessageHandler sends a message to the dm, like a Create event over the websocket
+func (app *application) createMessageHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Content       string      `json:"content"`
+		ReplyToID     null.String `json:"reply_to_id"`
+		AttachmentIDs []string    `json:"attachment_ids"`
+		ClientNonce   null.String `json:"client_nonce"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	dm, ok := app.getDMForParticipant(w, r)
+	if !ok {
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"messages": messages}, nil)
+	ctx := context.Background()
+	user := app.getUserContext(r)
+	canPost, err := app.policy.CanPostToDM(ctx, dm, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !canPost {
+		app.forbiddenResponse(w, r)
+		return
+	}
+
+	msg := &data.Message{
+		Content:       input.Content,
+		UserID:        user.ID,
+		ReplyToID:     input.ReplyToID,
+		AttachmentIDs: input.AttachmentIDs,
+		ClientNonce:   input.ClientNonce,
+	}
+	m, err := app.hub.sendMessage(ctx, dm, msg)
+	if err != nil {
+		app.messageErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"message": m}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateMessageHandler edits the content of the logged in user's message
+func (app *application) updateMessageHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Content string `json:"content"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	m, dm, ok := app.getMessageForPoster(w, r, true)
+	if !ok {
+		return
+	}
+
+	user := app.getUserContext(r)
+	m, err = app.hub.editMessage(context.Background(), dm, user.ID, m.ID, input.Content)
+	if err != nil {
+		app.messageErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": m}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteMessageHandler deletes the logged in user's message for everyone, or any message of
+// the dm only for the user with ?scope=me
+func (app *application) deleteMessageHandler(w http.ResponseWriter, r *http.Request) {
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = data.DeleteForEveryone
+	}
+	if scope != data.DeleteForMe && scope != data.DeleteForEveryone {
+		app.badRequestResponse(w, r, "invalid query param: scope (must be one of me and everyone)")
+		return
+	}
+
+	ctx := context.Background()
+	user := app.getUserContext(r)
+
+	if scope == data.DeleteForMe {
+		m, dm, ok := app.getMessageForParticipant(w, r)
+		if !ok {
+			return
+		}
+		err := app.hub.hideMessage(ctx, dm, user.ID, m.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusOK, envelope{"message": m}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	m, dm, ok := app.getMessageForPoster(w, r, true)
+	if !ok {
+		return
+	}
+
+	m, err := app.hub.deleteMessage(ctx, dm, user.ID, m.ID)
+	if err != nil {
+		app.messageErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": m}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addReactionHandler(w http.ResponseWriter, r *http.Request) {
+	app.reactToMessage(w, r, false)
+}
+
+func (app *application) removeReactionHandler(w http.ResponseWriter, r *http.Request) {
+	app.reactToMessage(w, r, true)
+}
+
+// reactToMessage adds or removes the logged in user's reaction named by the emoji param
+func (app *application) reactToMessage(w http.ResponseWriter, r *http.Request, remove bool) {
+	m, dm, ok := app.getMessageForPoster(w, r, false)
+	if !ok {
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	user := app.getUserContext(r)
+	reactor := data.BasicUserResp{ID: user.ID, Username: user.Username, Avatar: user.Avatar}
+	m, err := app.hub.reactToMessage(context.Background(), dm, reactor, m.ID, params.ByName("emoji"), remove)
+	if err != nil {
+		app.messageErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": m}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getReactorsHandler lists the users who reacted to the message with the emoji param.
+// after is the cursor of the last user of the previous page
+func (app *application) getReactorsHandler(w http.ResponseWriter, r *http.Request) {
+	m, _, ok := app.getMessageForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	var after int
+	var err error
+	if v := r.FormValue("after"); v != "" {
+		after, err = strconv.Atoi(v)
+		if err != nil {
+			app.badRequestResponse(w, r, "invalid query param: after")
+			return
+		}
+	}
+
+	limit := app.config.messages.pageSize
+	if v := r.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > app.config.messages.maxPageSize {
+			app.badRequestResponse(w, r, fmt.Sprintf("invalid query param: limit (must be between 1 and %d)", app.config.messages.maxPageSize))
+			return
+		}
+	}
+
+	// the reactions of a deleted message are scrubbed along with its content
+	if m.IsDeleted {
+		err = app.writeJSON(w, http.StatusOK, envelope{"users": []*data.Reactor{}, "has_more": false}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the param names the reaction the way reaction events do, custom emoji are looked up
+	// to the key they're stored under
+	ctx := context.Background()
+	params := httprouter.ParamsFromContext(r.Context())
+	reaction, err := app.hub.resolveReaction(ctx, app.getUserContext(r).ID, params.ByName("emoji"))
+	if err != nil {
+		app.messageErrorResponse(w, r, err)
+		return
+	}
+
+	users, hasMore, err := app.models.Reactions.GetReactors(ctx, m.ID, reaction, after, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "has_more": hasMore}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getMessageForPoster returns the message named by the messageID param and its dm when the
+// logged in user can react to the message or, with authorOnly, modify it. otherwise it
+// writes the error response
+func (app *application) getMessageForPoster(w http.ResponseWriter, r *http.Request, authorOnly bool) (*data.MessageResp, *data.DM, bool) {
+	m, dm, ok := app.getMessageForParticipant(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	ctx := context.Background()
+	user := app.getUserContext(r)
+	var (
+		allowed bool
+		err     error
+	)
+	if authorOnly {
+		allowed, err = app.policy.CanModifyMessage(ctx, dm, m, user.ID)
+	} else {
+		allowed, err = app.policy.CanReactToMessage(ctx, dm, m, user.ID)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, nil, false
+	}
+	if !allowed {
+		app.forbiddenResponse(w, r)
+		return nil, nil, false
+	}
+
+	return m, dm, true
+}
+
+// messageErrorResponse writes the response for an error returned while sending or changing a message
+func (app *application) messageErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		app.notFoundResponse(w, r)
+	case errors.Is(err, data.ErrInvalidReply),
+		errors.Is(err, data.ErrTooManyAttachments),
+		errors.Is(err, data.ErrInvalidAttachments),
+		errors.Is(err, data.ErrInvalidReaction),
+		errors.Is(err, data.ErrContentTooLong),
+		errors.Is(err, data.ErrEmptyMessage),
+		errors.Is(err, data.ErrTooManyReactions),
+		errors.Is(err, richtext.ErrDisallowed):
+		app.badRequestResponse(w, r, err.Error())
+	case errors.Is(err, data.ErrNotParticipant), errors.Is(err, data.ErrRequestLimit):
+		app.forbiddenResponse(w, r)
+	case errors.Is(err, data.ErrMessageDeleted):
+		app.errorResponse(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, data.ErrDeleteWindowExpired):
+		app.errorResponse(w, r, http.StatusForbidden, err.Error())
+	default:
+		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/kickbu2towski/brb-api/internal/data"
+)
+
+func (app *application) getMessageRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := dmListPageSize
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > dmListMaxPageSize {
+			app.badRequestResponse(w, r, fmt.Sprintf("invalid query param: limit (must be between 1 and %d)", dmListMaxPageSize))
+			return
+		}
+	}
+
+	user := app.getUserContext(r)
+	requests, hasMore, err := app.models.DMs.GetMessageRequests(context.Background(), user.ID, r.FormValue("before"), limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"requests": requests, "has_more": hasMore}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) acceptMessageRequestHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondToMessageRequest(w, r, data.RequestAccepted, false)
+}
+
+func (app *application) declineMessageRequestHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondToMessageRequest(w, r, data.RequestDeclined, false)
+}
+
+// blockMessageRequestHandler declines the request and blocks the requester
+func (app *application) blockMessageRequestHandler(w http.ResponseWriter, r *http.Request) {
+	app.respondToMessageRequest(w, r, data.RequestDeclined, true)
+}
+
+func (app *application) respondToMessageRequest(w http.ResponseWriter, r *http.Request, status string, block bool) {
+	ctx := context.Background()
+	dm, ok := app.getDMForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.getUserContext(r)
+	err := app.models.DMs.RespondToRequest(ctx, dm.ID, user.ID, status)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotPendingRequest):
+			app.badRequestResponse(w, r, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	dm.RequestStatus.SetValid(status)
+
+	if block {
+		err = app.models.Users.Block(ctx, user.ID, int(dm.RequestedBy.Int64))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.hub.publish(data.EventMessageRequest, data.MessageRequestPayload{DmID: dm.ID, Status: status}, dm.ParticipantIDs()...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"dm": dm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateDMPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DMPolicy data.DMPolicy `json:"dm_policy"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	user := app.getUserContext(r)
+	err = app.models.Users.SetDMPolicy(context.Background(), user.ID, input.DMPolicy)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidDMPolicy):
+			app.badRequestResponse(w, r, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"dm_policy": input.DMPolicy}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.readIntParam(r, "userID")
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	user := app.getUserContext(r)
+	if userID == user.ID {
+		app.badRequestResponse(w, r, "you cannot block yourself")
+		return
+	}
+
+	err = app.models.Users.Block(context.Background(), user.ID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "blocked user successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.readIntParam(r, "userID")
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	user := app.getUserContext(r)
+	err = app.models.Users.Unblock(context.Background(), user.ID, userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "unblocked user successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -61,7 +61,7 @@ func (app *application) UpdateRoomHandler(w http.ResponseWriter, r *http.Request
 		WelcomeMessage *string             `json:"welcomeMessage"`
 		Kick           *data.Kick          `json:"kick"`
 	}
-	err := app.readJSON(r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err.Error())
 		return
@@ -155,7 +155,7 @@ func (app *application) CreateRoomHandler(w http.ResponseWriter, r *http.Request
 		Language        string `json:"language"`
 	}
 
-	err := app.readJSON(r, &body)
+	err := app.readJSON(w, r, &body)
 	if err != nil {
 		app.badRequestResponse(w, r, err.Error())
 		return
@@ -26,12 +26,53 @@ func (app *application) routes() http.Handler {
 	router.Handler(http.MethodGet, "/v1/users/:userID", authMw.Then(http.HandlerFunc(app.getUserHandler)))
 	router.Handler(http.MethodPost, "/v1/users/:userID/follow", authMw.Then(http.HandlerFunc(app.followUserHandler)))
 	router.Handler(http.MethodDelete, "/v1/users/:userID/unfollow", authMw.Then(http.HandlerFunc(app.unfollowUserHandler)))
+	router.Handler(http.MethodPost, "/v1/users/:userID/block", authMw.Then(http.HandlerFunc(app.blockUserHandler)))
+	router.Handler(http.MethodDelete, "/v1/users/:userID/block", authMw.Then(http.HandlerFunc(app.unblockUserHandler)))
 
 	// messages
 	router.Handler(http.MethodGet, "/v1/messages", authMw.Then(http.HandlerFunc(app.getMessagesHandler)))
+	router.Handler(http.MethodGet, "/v1/messages/:messageID", authMw.Then(http.HandlerFunc(app.getMessageHandler)))
+	router.Handler(http.MethodGet, "/v1/messages/:messageID/history", authMw.Then(http.HandlerFunc(app.getMessageHistoryHandler)))
+	router.Handler(http.MethodGet, "/v1/messages/:messageID/replies", authMw.Then(http.HandlerFunc(app.getMessageRepliesHandler)))
+	router.Handler(http.MethodPatch, "/v1/messages/:messageID", authMw.Then(http.HandlerFunc(app.updateMessageHandler)))
+	router.Handler(http.MethodDelete, "/v1/messages/:messageID", authMw.Then(http.HandlerFunc(app.deleteMessageHandler)))
+	router.Handler(http.MethodGet, "/v1/messages/:messageID/reactions/:emoji", authMw.Then(http.HandlerFunc(app.getReactorsHandler)))
+	router.Handler(http.MethodPut, "/v1/messages/:messageID/reactions/:emoji", authMw.Then(http.HandlerFunc(app.addReactionHandler)))
+	router.Handler(http.MethodDelete, "/v1/messages/:messageID/reactions/:emoji", authMw.Then(http.HandlerFunc(app.removeReactionHandler)))
+
+	// attachments
+	router.Handler(http.MethodPost, "/v1/attachments", authMw.Then(http.HandlerFunc(app.uploadAttachmentHandler)))
+	router.Handler(http.MethodGet, "/v1/attachments/:attachmentID", authMw.Then(http.HandlerFunc(app.getAttachmentHandler)))
+	router.Handler(http.MethodGet, "/v1/attachments/:attachmentID/thumbnail", authMw.Then(http.HandlerFunc(app.getAttachmentThumbnailHandler)))
+
+	// custom emoji
+	router.Handler(http.MethodGet, "/v1/emoji", authMw.Then(http.HandlerFunc(app.getEmojiListHandler)))
+	router.Handler(http.MethodPost, "/v1/emoji", authMw.Then(http.HandlerFunc(app.uploadEmojiHandler)))
+	router.Handler(http.MethodGet, "/v1/emoji/:emojiID", authMw.Then(http.HandlerFunc(app.getEmojiHandler)))
+	router.Handler(http.MethodPatch, "/v1/emoji/:emojiID", authMw.Then(http.HandlerFunc(app.updateEmojiHandler)))
+	router.Handler(http.MethodDelete, "/v1/emoji/:emojiID", authMw.Then(http.HandlerFunc(app.deleteEmojiHandler)))
 
 	// dms
 	router.Handler(http.MethodPost, "/v1/dms", authMw.Then(http.HandlerFunc(app.createDMHandler)))
+	router.Handler(http.MethodPost, "/v1/dms/:dmID/messages", authMw.Then(http.HandlerFunc(app.createMessageHandler)))
+	router.Handler(http.MethodPost, "/v1/dms/:dmID/read", authMw.Then(http.HandlerFunc(app.markDMReadHandler)))
+	router.Handler(http.MethodGet, "/v1/dms/:dmID/pins", authMw.Then(http.HandlerFunc(app.getDMPinsHandler)))
+	router.Handler(http.MethodPut, "/v1/dms/:dmID/retention", authMw.Then(http.HandlerFunc(app.updateDMRetentionHandler)))
+	router.Handler(http.MethodPost, "/v1/dms/:dmID/request/accept", authMw.Then(http.HandlerFunc(app.acceptMessageRequestHandler)))
+	router.Handler(http.MethodPost, "/v1/dms/:dmID/request/decline", authMw.Then(http.HandlerFunc(app.declineMessageRequestHandler)))
+	router.Handler(http.MethodPost, "/v1/dms/:dmID/request/block", authMw.Then(http.HandlerFunc(app.blockMessageRequestHandler)))
+	router.Handler(http.MethodPost, "/v1/dms/:dmID/members", authMw.Then(http.HandlerFunc(app.addDMMemberHandler)))
+	router.Handler(http.MethodDelete, "/v1/dms/:dmID/members/:userID", authMw.Then(http.HandlerFunc(app.removeDMMemberHandler)))
+	router.Handler(http.MethodPost, "/v1/dms/:dmID/scheduled-messages", authMw.Then(http.HandlerFunc(app.createScheduledMessageHandler)))
+	router.Handler(http.MethodGet, "/v1/dms/:dmID/export", authMw.Then(http.HandlerFunc(app.exportDMHandler)))
+
+	// exports
+	router.Handler(http.MethodGet, "/v1/exports/:exportID", authMw.Then(http.HandlerFunc(app.getExportHandler)))
+	router.Handler(http.MethodGet, "/v1/exports/:exportID/download", authMw.Then(http.HandlerFunc(app.downloadExportHandler)))
+
+	// scheduled messages
+	router.Handler(http.MethodPatch, "/v1/scheduled-messages/:scheduledID", authMw.Then(http.HandlerFunc(app.updateScheduledMessageHandler)))
+	router.Handler(http.MethodDelete, "/v1/scheduled-messages/:scheduledID", authMw.Then(http.HandlerFunc(app.deleteScheduledMessageHandler)))
 
 	// logged in user routes
 	router.Handler(http.MethodGet, "/v1/me", authMw.Then(http.HandlerFunc(app.getLoggedInUserHandler)))
@@ -39,6 +80,9 @@ func (app *application) routes() http.Handler {
 	router.Handler(http.MethodGet, "/v1/me/friends", authMw.Then(http.HandlerFunc(app.getUsersForRelationHandler)))
 	router.Handler(http.MethodGet, "/v1/me/followers", authMw.Then(http.HandlerFunc(app.getUsersForRelationHandler)))
 	router.Handler(http.MethodGet, "/v1/me/dms", authMw.Then(http.HandlerFunc(app.getUserDMList)))
+	router.Handler(http.MethodGet, "/v1/me/message-requests", authMw.Then(http.HandlerFunc(app.getMessageRequestsHandler)))
+	router.Handler(http.MethodPut, "/v1/me/dm-policy", authMw.Then(http.HandlerFunc(app.updateDMPolicyHandler)))
+	router.Handler(http.MethodGet, "/v1/me/scheduled-messages", authMw.Then(http.HandlerFunc(app.getScheduledMessagesHandler)))
 
 	// rooms
 	router.Handler(http.MethodGet, "/v1/rooms", http.HandlerFunc(app.GetRoomsHandler))
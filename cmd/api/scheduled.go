@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kickbu2towski/brb-api/internal/data"
+	"github.com/kickbu2towski/brb-api/internal/richtext"
+	"gopkg.in/guregu/null.v4"
+)
+
+const (
+	// scheduledDispatchInterval is how often due scheduled messages are looked for
+	scheduledDispatchInterval = 5 * time.Second
+	// scheduledDispatchBatch is the number of due messages a dispatcher run sends at most
+	scheduledDispatchBatch = 100
+)
+
+func (app *application) createScheduledMessageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	var input struct {
+		Content       string      `json:"content"`
+		ReplyToID     null.String `json:"reply_to_id"`
+		AttachmentIDs []string    `json:"attachment_ids"`
+		SendAt        null.Time   `json:"send_at"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	if !input.SendAt.Valid {
+		app.badRequestResponse(w, r, "missing required field: send_at")
+		return
+	}
+
+	dm, ok := app.getDMForParticipant(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.getUserContext(r)
+	canPost, err := app.policy.CanPostToDM(ctx, dm, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !canPost {
+		app.forbiddenResponse(w, r)
+		return
+	}
+
+	s := &data.ScheduledMessage{
+		DmID:          dm.ID,
+		UserID:        user.ID,
+		Content:       input.Content,
+		ReplyToID:     input.ReplyToID,
+		AttachmentIDs: input.AttachmentIDs,
+		SendAt:        input.SendAt.Time,
+	}
+	err = app.models.Scheduled.Insert(ctx, s)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrSendAtInPast), errors.Is(err, data.ErrTooManyAttachments), errors.Is(err, data.ErrContentTooLong),
+			errors.Is(err, data.ErrEmptyMessage), errors.Is(err, richtext.ErrDisallowed):
+			app.badRequestResponse(w, r, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"scheduled_message": s}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getScheduledMessagesHandler lists the logged in user's pending messages, optionally
+// only the ones of the dm_id query param
+func (app *application) getScheduledMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	var dmID int
+	if v := r.FormValue("dm_id"); v != "" {
+		var err error
+		dmID, err = strconv.Atoi(v)
+		if err != nil {
+			app.badRequestResponse(w, r, "invalid query param: dm_id")
+			return
+		}
+	}
+
+	user := app.getUserContext(r)
+	scheduled, err := app.models.Scheduled.GetForUser(context.Background(), user.ID, dmID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"scheduled_messages": scheduled}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateScheduledMessageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	var input struct {
+		Content *string   `json:"content"`
+		SendAt  null.Time `json:"send_at"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	user := app.getUserContext(r)
+	s, err := app.models.Scheduled.Get(ctx, params.ByName("scheduledID"), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Content != nil {
+		s.Content = *input.Content
+	}
+	if input.SendAt.Valid {
+		s.SendAt = input.SendAt.Time
+	}
+
+	err = app.models.Scheduled.Update(ctx, s)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrSendAtInPast), errors.Is(err, data.ErrContentTooLong), errors.Is(err, data.ErrEmptyMessage),
+			errors.Is(err, richtext.ErrDisallowed):
+			app.badRequestResponse(w, r, err.Error())
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"scheduled_message": s}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteScheduledMessageHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	user := app.getUserContext(r)
+
+	err := app.models.Scheduled.Delete(context.Background(), params.ByName("scheduledID"), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "cancelled scheduled message successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// dispatchScheduledMessages sends the scheduled messages that are due. messages failing
+// with a temporary error stay pending and are retried on the next run
+func (app *application) dispatchScheduledMessages(ctx context.Context) error {
+	n, err := app.models.Scheduled.Dispatch(ctx, scheduledDispatchBatch, func(s *data.ScheduledMessage) error {
+		err := app.sendScheduledMessage(ctx, s)
+		if err != nil {
+			app.logger.Printf("error: sending scheduled message %s: %v", s.ID, err)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		app.logger.Printf("sent %d scheduled messages", n)
+	}
+	return nil
+}
+
+// sendScheduledMessage sends the message through the same path as messages sent over the
+// websocket. messages that can no longer be sent are dropped
+func (app *application) sendScheduledMessage(ctx context.Context, s *data.ScheduledMessage) error {
+	dm, err := app.models.DMs.GetDM(ctx, s.DmID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			app.logger.Printf("dropping scheduled message %s: dm %d no longer exists", s.ID, s.DmID)
+			return nil
+		}
+		return err
+	}
+
+	canPost, err := app.policy.CanPostToDM(ctx, dm, s.UserID)
+	if err != nil {
+		return err
+	}
+	if !canPost {
+		app.logger.Printf("dropping scheduled message %s: user %d can no longer post to dm %d", s.ID, s.UserID, s.DmID)
+		return nil
+	}
+
+	_, err = app.hub.sendMessage(ctx, dm, s.Message())
+	switch {
+	case errors.Is(err, data.ErrInvalidReply), errors.Is(err, data.ErrInvalidAttachments), errors.Is(err, data.ErrTooManyAttachments),
+		errors.Is(err, data.ErrContentTooLong), errors.Is(err, data.ErrEmptyMessage), errors.Is(err, richtext.ErrDisallowed),
+		errors.Is(err, data.ErrRequestLimit):
+		app.logger.Printf("dropping scheduled message %s: %v", s.ID, err)
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kickbu2towski/brb-api/internal/data"
+)
+
+const (
+	// typingRateLimit is the minimum interval between relayed typing events per dm
+	typingRateLimit = 2 * time.Second
+	// typingTimeout stops the indicator when the client doesn't send a stop event in time
+	typingTimeout = 6 * time.Second
+)
+
+type typingState struct {
+	dm       *data.DM
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+// handleTyping relays typing events to the other participants of the dm. typing
+// events are never persisted
+func (c *Client) handleTyping(ctx context.Context, e *data.Event) error {
+	b, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+
+	var payload struct {
+		DmID     int  `json:"dm_id"`
+		IsTyping bool `json:"is_typing"`
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.typing[payload.DmID]
+	if !payload.IsTyping {
+		if state != nil {
+			state.timer.Stop()
+			delete(c.typing, payload.DmID)
+			c.publishTyping(state.dm, false)
+		}
+		return nil
+	}
+
+	if state == nil {
+		// access is checked once per typing session
+		dm, err := c.hub.models.DMs.GetDM(ctx, payload.DmID)
+		if err != nil {
+			return err
+		}
+		canPost, err := c.hub.policy.CanPostToDM(ctx, dm, c.user.ID)
+		if err != nil {
+			return err
+		}
+		if !canPost {
+			return fmt.Errorf("%w: user can't post to the dm", errForbidden)
+		}
+
+		state = &typingState{dm: dm}
+		state.timer = time.AfterFunc(typingTimeout, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.typing[dm.ID] == state {
+				delete(c.typing, dm.ID)
+				c.publishTyping(dm, false)
+			}
+		})
+		c.typing[dm.ID] = state
+	} else {
+		state.timer.Reset(typingTimeout)
+	}
+
+	if time.Since(state.lastSent) < typingRateLimit {
+		return nil
+	}
+	state.lastSent = time.Now()
+	c.publishTyping(state.dm, true)
+
+	return nil
+}
+
+// stopTyping ends every typing indicator of the client, used when the connection closes
+func (c *Client) stopTyping() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for dmID, state := range c.typing {
+		state.timer.Stop()
+		delete(c.typing, dmID)
+		c.publishTyping(state.dm, false)
+	}
+}
+
+func (c *Client) publishTyping(dm *data.DM, isTyping bool) {
+	c.hub.publish(data.EventTyping, data.TypingPayload{
+		DmID:     dm.ID,
+		UserID:   c.user.ID,
+		IsTyping: isTyping,
+	}, otherParticipants(dm, c.user.ID)...)
+}
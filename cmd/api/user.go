@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -10,6 +11,11 @@ import (
 	"github.com/kickbu2towski/brb-api/internal/data"
 )
 
+const (
+	dmListPageSize    = 30
+	dmListMaxPageSize = 100
+)
+
 func (app *application) getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	if username == "" {
@@ -38,13 +44,45 @@ func (app *application) followUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	ctx := context.Background()
 	user := app.getUserContext(r)
-	err = app.models.Users.FollowUser(context.Background(), followingID, user.ID)
+	followed, err := app.models.Users.FollowUser(ctx, followingID, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	// following a user again succeeds without telling anyone
+	if followed {
+		follower := data.BasicUserResp{ID: user.ID, Username: user.Username, Avatar: user.Avatar}
+		app.hub.publish(data.EventFollowed, data.FollowedPayload{
+			Follower:    follower,
+			FollowingID: followingID,
+		}, followingID)
+
+		isFriends, err := app.models.Users.IsFriends(ctx, []int{user.ID, followingID})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if isFriends {
+			err = app.models.DMs.ClearRequest(ctx, user.ID, followingID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			following, err := app.models.Users.GetUser(ctx, strconv.Itoa(followingID))
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.hub.publish(data.EventBecameFriends, data.BecameFriendsPayload{Friend: *following}, user.ID)
+			app.hub.publish(data.EventBecameFriends, data.BecameFriendsPayload{Friend: follower}, followingID)
+		}
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "followed user successfully"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -58,13 +96,23 @@ func (app *application) unfollowUserHandler(w http.ResponseWriter, r *http.Reque
 		app.badRequestResponse(w, r, "missing required param: userID")
 		return
 	}
+	ctx := context.Background()
 	user := app.getUserContext(r)
-	err = app.models.Users.UnfollowUser(context.Background(), followingID, user.ID)
+
+	unfollowed, wasFriends, err := app.models.Users.UnfollowUser(ctx, followingID, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if unfollowed {
+		app.hub.publish(data.EventUnfollowed, data.UnfollowedPayload{
+			Follower:    data.BasicUserResp{ID: user.ID, Username: user.Username, Avatar: user.Avatar},
+			FollowingID: followingID,
+			WasFriends:  wasFriends,
+		}, followingID, user.ID)
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "unfollowed user successfully"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -121,13 +169,23 @@ func (app *application) getUserHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) getUserDMList(w http.ResponseWriter, r *http.Request) {
+	limit := dmListPageSize
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > dmListMaxPageSize {
+			app.badRequestResponse(w, r, fmt.Sprintf("invalid query param: limit (must be between 1 and %d)", dmListMaxPageSize))
+			return
+		}
+	}
+
 	user := app.getUserContext(r)
-	users, err := app.models.DMs.GetDMListForUser(context.Background(), user.ID)
+	dms, hasMore, err := app.models.DMs.GetDMListForUser(context.Background(), user.ID, r.FormValue("before"), limit)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"users": users}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"dms": dms, "has_more": hasMore}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
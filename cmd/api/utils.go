@@ -11,7 +11,7 @@ import (
 	"github.com/livekit/protocol/livekit"
 )
 
-func Includes(input []int, key int) bool {
+func Includes[T comparable](input []T, key T) bool {
 	var exists bool
 	for _, v := range input {
 		if v == key {
@@ -22,6 +22,17 @@ func Includes(input []int, key int) bool {
 	return exists
 }
 
+// otherParticipants returns the IDs of the dm participants except userID
+func otherParticipants(dm *data.DM, userID int) []int {
+	ids := make([]int, 0, len(dm.Participants))
+	for _, p := range dm.Participants {
+		if p.ID != userID {
+			ids = append(ids, p.ID)
+		}
+	}
+	return ids
+}
+
 func (app *application) IsRoomExists(ctx context.Context, r *http.Request) (*livekit.Room, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 	roomID := params.ByName("roomID")
@@ -3,30 +3,59 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
 	"github.com/kickbu2towski/brb-api/internal/data"
+	"github.com/kickbu2towski/brb-api/internal/policy"
+	"github.com/kickbu2towski/brb-api/internal/preview"
+	"github.com/kickbu2towski/brb-api/internal/richtext"
+	"gopkg.in/guregu/null.v4"
 )
 
+// linkPreviewTimeout bounds fetching and saving a message's link preview
+const linkPreviewTimeout = 10 * time.Second
+
+// maxWSMessageSize is the size in bytes of the largest message read from a client, which
+// fits a message of data.MaxContentLength characters with room to spare
+const maxWSMessageSize = 64 << 10
+
 type BroadcastMessage struct {
 	BroadcastTo []int          `json:"-"`
 	Data        map[string]any `json:"data"`
 	toEveryone  bool           `json:"-"`
+	// toClient limits the message to a single connection
+	toClient *Client `json:"-"`
 }
 
 type Hub struct {
 	clients   map[*Client]bool
 	broadcast chan *BroadcastMessage
 	models    *data.Models
+	policy    *policy.Policy
+	previews  preview.Fetcher
+	// deleteWindow is how long after sending messages can be deleted for everyone, 0 is no limit
+	deleteWindow time.Duration
+	// reactions are the emoji messages can be reacted with
+	reactions []string
 }
 
-func NewHub(models *data.Models) *Hub {
+func NewHub(models *data.Models, policy *policy.Policy, previews preview.Fetcher, deleteWindow time.Duration, reactions []string) *Hub {
 	return &Hub{
-		clients:   make(map[*Client]bool),
-		broadcast: make(chan *BroadcastMessage),
-		models:    models,
+		clients:      make(map[*Client]bool),
+		broadcast:    make(chan *BroadcastMessage),
+		models:       models,
+		policy:       policy,
+		previews:     previews,
+		deleteWindow: deleteWindow,
+		reactions:    reactions,
 	}
 }
 
@@ -35,7 +64,9 @@ func (h *Hub) run() {
 		msg := <-h.broadcast
 		for client := range h.clients {
 			allowed := msg.toEveryone
-			if !allowed {
+			if msg.toClient != nil {
+				allowed = client == msg.toClient
+			} else if !allowed {
 				allowed = Includes(msg.BroadcastTo, client.user.ID)
 			}
 			if allowed {
@@ -49,13 +80,306 @@ func (h *Hub) run() {
 	}
 }
 
+// publish sends a PublishEvent of the given type to the listed users
+func (h *Hub) publish(eventType string, payload any, broadcastTo ...int) {
+	h.broadcast <- &BroadcastMessage{
+		BroadcastTo: broadcastTo,
+		Data: map[string]any{
+			"name":    "PublishEvent",
+			"type":    eventType,
+			"payload": payload,
+		},
+	}
+}
+
+// publishReadReceipt broadcasts the user's current read marker to the dm participants
+func (h *Hub) publishReadReceipt(ctx context.Context, dm *data.DM, userID int) (*data.ReadReceipt, error) {
+	receipt, err := h.models.DMs.GetReadReceipt(ctx, dm.ID, userID)
+	if err != nil {
+		return nil, err
+	}
+	h.publish(data.EventRead, receipt, dm.ParticipantIDs()...)
+	return receipt, nil
+}
+
+// publishUnreadCounts sends each of the users their current unread counts for the dm
+func (h *Hub) publishUnreadCounts(ctx context.Context, dmID int, userIDs ...int) error {
+	for _, userID := range userIDs {
+		count, total, err := h.models.DMs.GetUnreadCounts(ctx, dmID, userID)
+		if err != nil {
+			return err
+		}
+		h.publish(data.EventUnreadCount, data.UnreadCountPayload{
+			DmID:             dmID,
+			UnreadCount:      count,
+			TotalUnreadCount: total,
+		}, userID)
+	}
+	return nil
+}
+
+// publishLinkPreview fetches the preview of the url, stores it with the message and
+// pushes the updated message to the dm participants
+func (h *Hub) publishLinkPreview(dm *data.DM, msgID, url string) {
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+
+	p, err := h.previews.Fetch(ctx, url)
+	if err != nil {
+		if !errors.Is(err, preview.ErrNoPreview) {
+			log.Println("error: fetching link preview:", err)
+		}
+		return
+	}
+
+	err = h.models.Messages.SetLinkPreview(ctx, msgID, p)
+	if err != nil {
+		log.Println("error: saving link preview:", err)
+		return
+	}
+
+	m, err := h.models.Messages.GetMessage(ctx, msgID, -1)
+	if err != nil {
+		log.Println("error: getting message after saving link preview:", err)
+		return
+	}
+
+	h.publish(data.EventMessageUpdated, m, dm.ParticipantIDs()...)
+}
+
+// sendMessage saves the message in the dm and broadcasts it to the participants
+func (h *Hub) sendMessage(ctx context.Context, dm *data.DM, msg *data.Message) (*data.MessageResp, error) {
+	if strings.TrimSpace(msg.Content) == "" && len(msg.AttachmentIDs) == 0 {
+		return nil, data.ErrEmptyMessage
+	}
+	err := msg.ParseContent()
+	if err != nil {
+		return nil, err
+	}
+	msg.ContentAST, err = h.models.Emoji.ResolveContent(ctx, msg.UserID, msg.ContentAST)
+	if err != nil {
+		return nil, err
+	}
+	msg.DmID = dm.ID
+	msg.Mentions = data.ParseMentions(msg.ContentAST, dm.Participants)
+	inserted, err := h.models.Messages.InsertMessage(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	if !inserted {
+		return h.publishDuplicate(ctx, msg.ID)
+	}
+
+	return h.publishNewMessage(ctx, dm, msg.ID)
+}
+
+// forwardMessage copies the message into the dm as a message of userID and broadcasts it
+func (h *Hub) forwardMessage(ctx context.Context, dm *data.DM, userID int, sourceID string, nonce null.String) (*data.MessageResp, error) {
+	id, inserted, err := h.models.Messages.ForwardMessage(ctx, sourceID, dm.ID, userID, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if !inserted {
+		return h.publishDuplicate(ctx, id)
+	}
+	return h.publishNewMessage(ctx, dm, id)
+}
+
+// publishDuplicate answers a retried send with the message already stored for its nonce.
+// only the sender's clients are told again, the mentions and unread counts were published
+// along with the original
+func (h *Hub) publishDuplicate(ctx context.Context, msgID string) (*data.MessageResp, error) {
+	m, err := h.models.Messages.GetMessage(ctx, msgID, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	h.publish("DM", m, m.User.ID)
+	return m, nil
+}
+
+// publishNewMessage broadcasts a newly saved message to the dm participants, along with
+// its mentions, link preview and the updated unread counts
+func (h *Hub) publishNewMessage(ctx context.Context, dm *data.DM, msgID string) (*data.MessageResp, error) {
+	m, err := h.publishMessage(ctx, dm, msgID)
+	if err != nil {
+		return nil, err
+	}
+
+	h.publishMentions(m)
+
+	if url := preview.FirstURL(m.Content); url != "" && m.LinkPreview == nil {
+		go h.publishLinkPreview(dm, m.ID, url)
+	}
+
+	err = h.publishUnreadCounts(ctx, dm.ID, otherParticipants(dm, m.User.ID)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// editMessage replaces the content of the user's message and broadcasts the edited message
+func (h *Hub) editMessage(ctx context.Context, dm *data.DM, userID int, id, content string) (*data.MessageResp, error) {
+	msg, err := h.models.Messages.GetMessage(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := data.MentionedUserIDs(msg.Mentions)
+	msg.Content = content
+	err = msg.ParseContent()
+	if err != nil {
+		return nil, err
+	}
+	msg.ContentAST, err = h.models.Emoji.ResolveContent(ctx, userID, msg.ContentAST)
+	if err != nil {
+		return nil, err
+	}
+	msg.Mentions = data.ParseMentions(msg.ContentAST, dm.Participants)
+	msg.IsEdited = true
+	err = h.models.Messages.UpdateMessage(ctx, id, msg)
+	if err != nil {
+		return nil, err
+	}
+	h.publishMentions(msg, previous...)
+
+	return h.publishMessage(ctx, dm, id)
+}
+
+// deleteMessage deletes the user's message for everyone and broadcasts its tombstone
+func (h *Hub) deleteMessage(ctx context.Context, dm *data.DM, userID int, id string) (*data.MessageResp, error) {
+	_, err := h.models.Messages.GetMessage(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.models.Messages.DeleteMessage(ctx, id, h.deleteWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := h.publishMessage(ctx, dm, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.publishUnreadCounts(ctx, dm.ID, otherParticipants(dm, userID)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// hideMessage deletes the message for the user only and tells their other clients
+func (h *Hub) hideMessage(ctx context.Context, dm *data.DM, userID int, id string) error {
+	err := h.models.Messages.HideMessage(ctx, id, userID)
+	if err != nil {
+		return err
+	}
+
+	h.publish(data.EventMessageHidden, data.MessageHiddenPayload{DmID: dm.ID, MessageID: id}, userID)
+	return h.publishUnreadCounts(ctx, dm.ID, userID)
+}
+
+// reactToMessage adds or removes the user's reaction and broadcasts the change. only allowed
+// and custom emoji can be added, while any reaction can be removed
+func (h *Hub) reactToMessage(ctx context.Context, dm *data.DM, user data.BasicUserResp, id, reaction string, remove bool) (*data.MessageResp, error) {
+	resolved, err := h.resolveReaction(ctx, user.ID, reaction)
+	switch {
+	case err == nil:
+		reaction = resolved
+	case !remove || !errors.Is(err, data.ErrInvalidReaction):
+		return nil, err
+	}
+
+	var changed bool
+	if remove {
+		changed, err = h.models.Reactions.Delete(ctx, reaction, id, user.ID)
+	} else {
+		changed, err = h.models.Reactions.Insert(ctx, reaction, id, user.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		h.publish(data.EventReaction, data.ReactionPayload{
+			DmID:      dm.ID,
+			MessageID: id,
+			Reaction:  reaction,
+			User:      user,
+			Removed:   remove,
+		}, dm.ParticipantIDs()...)
+	}
+
+	return h.models.Messages.GetMessage(ctx, id, -1)
+}
+
+// resolveReaction returns the reaction as it is stored. the user's custom emoji can be named
+// with their :name: shortcode, anyone's custom emoji with their data.EmojiReaction
+func (h *Hub) resolveReaction(ctx context.Context, userID int, reaction string) (string, error) {
+	if Includes(h.reactions, reaction) {
+		return reaction, nil
+	}
+
+	var (
+		e   *data.CustomEmoji
+		err error
+	)
+	if name, ok := data.ParseEmojiShortcode(reaction); ok {
+		e, err = h.models.Emoji.GetByName(ctx, userID, name)
+	} else if emojiID, ok := data.ParseEmojiReaction(reaction); ok {
+		e, err = h.models.Emoji.Get(ctx, emojiID)
+	} else {
+		return "", data.ErrInvalidReaction
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return "", data.ErrInvalidReaction
+		default:
+			return "", err
+		}
+	}
+
+	return data.EmojiReaction(e.ID), nil
+}
+
+// publishMessage broadcasts the current version of a message to the dm participants
+func (h *Hub) publishMessage(ctx context.Context, dm *data.DM, id string) (*data.MessageResp, error) {
+	m, err := h.models.Messages.GetMessage(ctx, id, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	h.publish("DM", m, dm.ParticipantIDs()...)
+	return m, nil
+}
+
+// publishMentions notifies the users mentioned in the message, other than its author and
+// the already notified users
+func (h *Hub) publishMentions(m *data.MessageResp, notified ...int) {
+	for _, userID := range data.MentionedUserIDs(m.Mentions) {
+		if userID == m.User.ID || Includes(notified, userID) {
+			continue
+		}
+		h.publish(data.EventMention, data.MentionPayload{DmID: m.DmID, Message: m}, userID)
+	}
+}
+
 type Client struct {
 	user *data.BasicUserResp
 	hub  *Hub
 	conn *websocket.Conn
+
+	mu     sync.Mutex
+	typing map[int]*typingState
 }
 
-func (c *Client) save(e *data.Event) (string, error) {
+func (c *Client) save(dm *data.DM, e *data.Event) (string, error) {
 	var msgID string
 	b, err := json.Marshal(e.Payload)
 	if err != nil {
@@ -63,18 +387,6 @@ func (c *Client) save(e *data.Event) (string, error) {
 	}
 
 	switch e.Type {
-	case "Create":
-		var m data.Message
-		err = json.Unmarshal(b, &m)
-		if err != nil {
-			return msgID, err
-		}
-		msgID = m.ID
-		m.UserID = c.user.ID
-		err = c.hub.models.Messages.InsertMessage(context.Background(), &m)
-		if err != nil {
-			return msgID, err
-		}
 	case "Edit", "Delete", "Reaction":
 		ctx := context.Background()
 
@@ -84,6 +396,7 @@ func (c *Client) save(e *data.Event) (string, error) {
 			Content  string `json:"content"`
 			Reaction string `json:"reaction"`
 			ToRemove bool   `json:"toRemove"`
+			Scope    string `json:"scope"`
 		}
 
 		err = json.Unmarshal(b, &payload)
@@ -93,29 +406,38 @@ func (c *Client) save(e *data.Event) (string, error) {
 
 		msgID = payload.ID
 
-		if e.Type != "Reaction" {
-			msg, err := c.hub.models.Messages.GetMessage(ctx, payload.ID, c.user.ID)
-			if err != nil {
-				return msgID, err
-			}
-			if e.Type == "Edit" {
-				msg.Content = payload.Content
-				msg.IsEdited = true
-			} else if e.Type == "Delete" {
-				msg.IsDeleted = true
-			}
-			err = c.hub.models.Messages.UpdateMessage(ctx, payload.ID, msg)
-			if err != nil {
-				return msgID, err
-			}
-		} else {
-			if payload.ToRemove {
-				err = c.hub.models.Reactions.Delete(ctx, payload.Reaction, payload.ID, c.user.ID)
-			} else {
-				err = c.hub.models.Reactions.Insert(ctx, payload.Reaction, payload.ID, c.user.ID)
+		switch e.Type {
+		case "Edit":
+			_, err = c.hub.editMessage(ctx, dm, c.user.ID, payload.ID, payload.Content)
+		case "Delete":
+			if payload.Scope != "" && payload.Scope != data.DeleteForEveryone {
+				return msgID, errInvalidDeleteScope
 			}
+			_, err = c.hub.deleteMessage(ctx, dm, c.user.ID, payload.ID)
+		default:
+			_, err = c.hub.reactToMessage(ctx, dm, *c.user, payload.ID, payload.Reaction, payload.ToRemove)
+		}
+		if err != nil {
+			return msgID, err
+		}
+	case "Read":
+		ctx := context.Background()
+
+		var payload struct {
+			ID string `json:"id"`
+		}
+		err = json.Unmarshal(b, &payload)
+		if err != nil {
+			return msgID, err
+		}
+
+		msgID = payload.ID
+		msg, err := c.hub.models.Messages.GetMessage(ctx, payload.ID, -1)
+		if err != nil {
+			return msgID, err
 		}
 
+		err = c.hub.models.DMs.MarkRead(ctx, msg.DmID, c.user.ID, payload.ID)
 		if err != nil {
 			return msgID, err
 		}
@@ -124,8 +446,68 @@ func (c *Client) save(e *data.Event) (string, error) {
 	return msgID, nil
 }
 
+var (
+	errForbidden          = errors.New("forbidden")
+	errInvalidDeleteScope = errors.New("scope must be one of me and everyone")
+)
+
+// isClientError reports whether err rejects the client's event rather than failing the
+// connection. the client is told about these and can keep using the connection
+func isClientError(err error) bool {
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, errForbidden),
+		errors.Is(err, errInvalidDeleteScope),
+		errors.Is(err, pgx.ErrNoRows),
+		errors.Is(err, data.ErrNotParticipant),
+		errors.Is(err, data.ErrRequestLimit),
+		errors.Is(err, data.ErrContentTooLong),
+		errors.Is(err, data.ErrEmptyMessage),
+		errors.Is(err, data.ErrInvalidReply),
+		errors.Is(err, data.ErrTooManyAttachments),
+		errors.Is(err, data.ErrInvalidAttachments),
+		errors.Is(err, data.ErrInvalidReaction),
+		errors.Is(err, data.ErrTooManyReactions),
+		errors.Is(err, data.ErrTooManyPins),
+		errors.Is(err, data.ErrSendAtInPast),
+		errors.Is(err, data.ErrMessageDeleted),
+		errors.Is(err, data.ErrDeleteWindowExpired),
+		errors.Is(err, data.ErrCannotForward),
+		errors.Is(err, richtext.ErrDisallowed),
+		errors.As(err, &typeError):
+		return true
+	}
+	return false
+}
+
+// reject tells the client why its event was rejected
+func (c *Client) reject(e *data.Event, reason error) {
+	nonce, _ := e.Payload["client_nonce"].(string)
+	id, _ := e.Payload["id"].(string)
+
+	msg := reason.Error()
+	if errors.Is(reason, pgx.ErrNoRows) {
+		msg = "the requested resource could not be found"
+	}
+
+	c.hub.broadcast <- &BroadcastMessage{
+		toClient: c,
+		Data: map[string]any{
+			"name": "PublishEvent",
+			"type": data.EventError,
+			"payload": data.ErrorPayload{
+				EventType:   e.Type,
+				ClientNonce: null.NewString(nonce, nonce != ""),
+				MessageID:   null.NewString(id, id != ""),
+				Error:       msg,
+			},
+		},
+	}
+}
+
 func (c *Client) read() {
 	defer func() {
+		c.stopTyping()
 		delete(c.hub.clients, c)
 	}()
 	for {
@@ -142,49 +524,238 @@ func (c *Client) read() {
 			break
 		}
 
-		if e.Name == "DMEvent" {
-			if e.UserID != c.user.ID {
-				log.Println("forbidden")
-				break
-			}
+		if e.Name != data.EventTyping && e.Name != "DMEvent" {
+			continue
+		}
+		if e.UserID != c.user.ID {
+			log.Println("forbidden")
+			break
+		}
 
-			if len(e.BroadcastTo) != 2 {
-				log.Println("error: broadcastTo length mismatch")
-				break
+		if e.Name == data.EventTyping {
+			err = c.handleTyping(context.Background(), &e)
+		} else {
+			err = c.handleDMEvent(context.Background(), &e)
+		}
+		if err != nil {
+			if isClientError(err) {
+				c.reject(&e, err)
+				continue
 			}
+			log.Printf("error: handling %s %s: %v", e.Name, e.Type, err)
+			break
+		}
+	}
+}
 
-			isFriends, err := c.hub.models.Users.IsFriends(context.Background(), e.BroadcastTo)
-			if err != nil {
-				log.Println("error: checking whether broadcastTo participants are friends", err)
-				break
-			}
-			if !isFriends {
-				log.Println("participants should be friends")
-				break
-			}
+// handleDMEvent authorizes the DMEvent against the policy and applies it
+func (c *Client) handleDMEvent(ctx context.Context, e *data.Event) error {
+	dm, m, err := c.getDMForEvent(ctx, e)
+	if err != nil {
+		return err
+	}
 
-			msgID, err := c.save(&e)
-			m, err := c.hub.models.Messages.GetMessage(context.Background(), msgID, -1)
-			if err != nil {
-				log.Println("error: getting message after saving DMEvent:", err)
-				break
-			}
+	allowed, err := c.authorize(ctx, dm, m, e)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: user can't %s in the dm", errForbidden, e.Type)
+	}
 
-			if err != nil {
-				log.Println("error: saving DMEvent from ws message:", err)
-				break
-			}
+	switch {
+	case e.Type == "Delete" && e.Payload["scope"] == data.DeleteForMe:
+		return c.hide(ctx, dm, e)
+	case e.Type == "Create":
+		return c.create(ctx, dm, e)
+	case e.Type == "Forward":
+		return c.forward(ctx, dm, e)
+	case e.Type == data.EventPin:
+		return c.pin(ctx, dm, e)
+	}
 
-			c.hub.broadcast <- &BroadcastMessage{
-				BroadcastTo: e.BroadcastTo,
-				Data: map[string]any{
-					"name":    "PublishEvent",
-					"type":    "DM",
-					"payload": m,
-				},
-			}
+	_, err = c.save(dm, e)
+	if err != nil {
+		return err
+	}
+
+	if e.Type == data.EventRead {
+		_, err = c.hub.publishReadReceipt(ctx, dm, c.user.ID)
+		if err != nil {
+			return err
+		}
+		return c.hub.publishUnreadCounts(ctx, dm.ID, c.user.ID)
+	}
+
+	return nil
+}
+
+// create sends the message in the Create event to the dm, or schedules it when it has a
+// send_at. the id and creation time are assigned by the server, the client identifies
+// its message through the nonce
+func (c *Client) create(ctx context.Context, dm *data.DM, e *data.Event) error {
+	b, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+
+	var payload struct {
+		data.Message
+		SendAt null.Time `json:"send_at"`
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		return err
+	}
+
+	m := payload.Message
+	m.UserID = c.user.ID
+
+	if payload.SendAt.Valid {
+		s := &data.ScheduledMessage{
+			DmID:          dm.ID,
+			UserID:        c.user.ID,
+			Content:       m.Content,
+			ReplyToID:     m.ReplyToID,
+			AttachmentIDs: m.AttachmentIDs,
+			SendAt:        payload.SendAt.Time,
+		}
+		err = c.hub.models.Scheduled.Insert(ctx, s)
+		if err != nil {
+			return err
+		}
+		c.hub.publish(data.EventScheduled, data.ScheduledPayload{ClientNonce: m.ClientNonce, Message: s}, c.user.ID)
+		return nil
+	}
+
+	_, err = c.hub.sendMessage(ctx, dm, &m)
+	return err
+}
+
+// forward copies the message named in the Forward event into the dm. the user must be a
+// participant of the dm the message was sent to
+func (c *Client) forward(ctx context.Context, dm *data.DM, e *data.Event) error {
+	b, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+
+	var payload struct {
+		ID          string      `json:"id"`
+		ClientNonce null.String `json:"client_nonce"`
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		return err
+	}
+
+	source, err := c.hub.models.Messages.GetMessage(ctx, payload.ID, -1)
+	if err != nil {
+		return err
+	}
+
+	sourceDM, err := c.hub.models.DMs.GetDM(ctx, source.DmID)
+	if err != nil {
+		return err
+	}
+	if !c.hub.policy.CanReadMessage(sourceDM, source, c.user.ID) {
+		return fmt.Errorf("%w: user can't read the forwarded message", errForbidden)
+	}
+
+	_, err = c.hub.forwardMessage(ctx, dm, c.user.ID, source.ID, payload.ClientNonce)
+	return err
+}
+
+// pin pins or unpins the message in the Pin event. the participants are only told when
+// the message was pinned or unpinned, repeating either is a no-op
+func (c *Client) pin(ctx context.Context, dm *data.DM, e *data.Event) error {
+	id, _ := e.Payload["id"].(string)
+	toRemove, _ := e.Payload["toRemove"].(bool)
+
+	var changed bool
+	var err error
+	if toRemove {
+		changed, err = c.hub.models.Pins.Delete(ctx, dm.ID, id)
+	} else {
+		changed, err = c.hub.models.Pins.Insert(ctx, dm.ID, id, c.user.ID)
+	}
+	if err != nil || !changed {
+		return err
+	}
+
+	c.hub.publish(data.EventPin, data.PinPayload{
+		DmID:      dm.ID,
+		MessageID: id,
+		IsPinned:  !toRemove,
+		By:        *c.user,
+	}, dm.ParticipantIDs()...)
+	return nil
+}
+
+// hide deletes the message in the Delete event for the user only. any participant can
+// hide any message of the dm
+func (c *Client) hide(ctx context.Context, dm *data.DM, e *data.Event) error {
+	id, _ := e.Payload["id"].(string)
+	return c.hub.hideMessage(ctx, dm, c.user.ID, id)
+}
+
+// getDMForEvent returns the dm the event belongs to and the message it refers to. Create
+// and Forward events name the dm in the payload and have no message, other events are
+// resolved through the message they refer to
+func (c *Client) getDMForEvent(ctx context.Context, e *data.Event) (*data.DM, *data.MessageResp, error) {
+	b, err := json.Marshal(e.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var payload struct {
+		ID   string `json:"id"`
+		DmID int    `json:"dm_id"`
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if e.Type == "Create" || e.Type == "Forward" {
+		dm, err := c.hub.models.DMs.GetDM(ctx, payload.DmID)
+		return dm, nil, err
+	}
+
+	m, err := c.hub.models.Messages.GetMessage(ctx, payload.ID, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dm, err := c.hub.models.DMs.GetDM(ctx, m.DmID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dm, m, nil
+}
+
+// authorize checks the DMEvent against the policy. m is the message the event refers to,
+// nil for Create and Forward events
+func (c *Client) authorize(ctx context.Context, dm *data.DM, m *data.MessageResp, e *data.Event) (bool, error) {
+	p := c.hub.policy
+	switch e.Type {
+	case "Create", "Forward":
+		return p.CanPostToDM(ctx, dm, c.user.ID)
+	case "Edit":
+		return p.CanModifyMessage(ctx, dm, m, c.user.ID)
+	case "Delete":
+		// deleting for me only needs the user to see the message
+		if e.Payload["scope"] == data.DeleteForMe {
+			return p.CanReadMessage(dm, m, c.user.ID), nil
 		}
+		return p.CanModifyMessage(ctx, dm, m, c.user.ID)
+	case "Reaction", data.EventPin:
+		return p.CanReactToMessage(ctx, dm, m, c.user.ID)
+	case data.EventRead:
+		return p.CanReadMessage(dm, m, c.user.ID), nil
 	}
+	return false, nil
 }
 
 func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
@@ -201,6 +772,7 @@ func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	conn.SetReadLimit(maxWSMessageSize)
 
 	// TODO: adding this closing the connection. figure out why.
 	// defer conn.Close()
@@ -211,8 +783,9 @@ func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
 			Username: user.Username,
 			Avatar:   user.Avatar,
 		},
-		hub:  app.hub,
-		conn: conn,
+		hub:    app.hub,
+		conn:   conn,
+		typing: make(map[int]*typingState),
 	}
 	app.hub.clients[client] = true
 
@@ -9,6 +9,7 @@ require (
 	github.com/justinas/alice v1.2.0
 	github.com/livekit/protocol v1.6.0
 	github.com/livekit/server-sdk-go v1.0.15
+	golang.org/x/net v0.12.0
 	golang.org/x/oauth2 v0.9.0
 	gopkg.in/guregu/null.v4 v4.0.0
 )
@@ -79,7 +80,6 @@ require (
 	go.uber.org/zap v1.24.0 // indirect
 	golang.org/x/crypto v0.11.0 // indirect
 	golang.org/x/exp v0.0.0-20230801115018-d63ba01acd4b // indirect
-	golang.org/x/net v0.12.0 // indirect
 	golang.org/x/sync v0.2.0 // indirect
 	golang.org/x/sys v0.10.0 // indirect
 	golang.org/x/text v0.11.0 // indirect
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gopkg.in/guregu/null.v4"
+)
+
+const MaxAttachmentsPerMessage = 10
+
+var (
+	ErrTooManyAttachments = errors.New("message has too many attachments")
+	ErrInvalidAttachments = errors.New("attachments must be uploaded by the sender and not used by another message")
+)
+
+type Attachment struct {
+	ID           string      `json:"id"`
+	UserID       int         `json:"user_id"`
+	MessageID    null.String `json:"message_id"`
+	Filename     string      `json:"filename"`
+	MimeType     string      `json:"mime_type"`
+	Size         int64       `json:"size"`
+	StorageKey   string      `json:"-"`
+	Width        null.Int    `json:"width"`
+	Height       null.Int    `json:"height"`
+	ThumbnailKey null.String `json:"-"`
+	HasThumbnail bool        `json:"has_thumbnail"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+type AttachmentModel struct {
+	Pool *pgxpool.Pool
+}
+
+func (m *AttachmentModel) Insert(ctx context.Context, a *Attachment) error {
+	stmt := `
+		INSERT INTO attachments(id, user_id, filename, mime_type, size, storage_key, width, height, thumbnail_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING created_at
+	`
+	args := []any{a.ID, a.UserID, a.Filename, a.MimeType, a.Size, a.StorageKey, a.Width, a.Height, a.ThumbnailKey}
+	return m.Pool.QueryRow(ctx, stmt, args...).Scan(&a.CreatedAt)
+}
+
+func (m *AttachmentModel) Get(ctx context.Context, id string) (*Attachment, error) {
+	stmt := `
+		SELECT id, user_id, message_id, filename, mime_type, size, storage_key, width, height, thumbnail_key, created_at
+		FROM attachments WHERE id = $1
+	`
+
+	var a Attachment
+	err := m.Pool.QueryRow(ctx, stmt, id).Scan(
+		&a.ID, &a.UserID, &a.MessageID, &a.Filename, &a.MimeType, &a.Size,
+		&a.StorageKey, &a.Width, &a.Height, &a.ThumbnailKey, &a.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	a.HasThumbnail = a.ThumbnailKey.Valid
+	return &a, nil
+}
+
+// DeleteUnlinkedBefore deletes up to limit attachments uploaded before t that were never
+// linked to a message and aren't waiting in a scheduled message. it returns the blob keys
+// no remaining attachment uses, which the caller should remove from storage
+func (m *AttachmentModel) DeleteUnlinkedBefore(ctx context.Context, t time.Time, limit int) (int, []string, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	stmt := `
+		DELETE FROM attachments WHERE id IN (
+			SELECT a.id FROM attachments a
+			WHERE a.message_id IS NULL AND a.created_at < $1
+			AND NOT EXISTS (SELECT 1 FROM scheduled_messages s WHERE a.id = ANY(s.attachment_ids))
+			ORDER BY a.created_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING storage_key, thumbnail_key
+	`
+	rows, err := tx.Query(ctx, stmt, t, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	n := 0
+	deletedKeys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		var thumbnailKey null.String
+		err = rows.Scan(&key, &thumbnailKey)
+		if err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		n++
+		deletedKeys = append(deletedKeys, key)
+		if thumbnailKey.Valid {
+			deletedKeys = append(deletedKeys, thumbnailKey.String)
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, nil, err
+	}
+	if n == 0 {
+		return 0, nil, nil
+	}
+
+	keys, err := unusedBlobKeys(ctx, tx, deletedKeys)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return n, keys, tx.Commit(ctx)
+}
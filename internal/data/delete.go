@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/kickbu2towski/brb-api/internal/richtext"
+	"gopkg.in/guregu/null.v4"
+)
+
+// delete scopes of a Delete event. deleting for me only hides the message from the user,
+// deleting for everyone turns it into a tombstone
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+var (
+	ErrMessageDeleted      = errors.New("the message was deleted")
+	ErrDeleteWindowExpired = errors.New("the message is too old to be deleted for everyone")
+)
+
+// scrub leaves only the tombstone of a deleted message: who sent it, when and what it
+// replied to
+func (m *MessageResp) scrub() {
+	m.Content = ""
+	m.ContentAST = []*richtext.Node{}
+	m.PlainText = null.String{}
+	m.Mentions = []*Mention{}
+	m.Reactions = nil
+	m.Attachments = []*Attachment{}
+	m.LinkPreview = nil
+	m.ForwardedFrom = nil
+}
+
+// DeleteMessage deletes the message for everyone. a window greater than 0 is how long after
+// sending a message can be deleted. the content is kept until PurgeDeleted erases it
+func (m *MessageModel) DeleteMessage(ctx context.Context, id string, window time.Duration) error {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var createdAt time.Time
+	var isDeleted bool
+	stmt := `SELECT created_at, is_deleted FROM messages WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, stmt, id).Scan(&createdAt, &isDeleted)
+	if err != nil {
+		return err
+	}
+	if isDeleted {
+		return ErrMessageDeleted
+	}
+	if window > 0 && time.Since(createdAt) > window {
+		return ErrDeleteWindowExpired
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE messages SET is_deleted = TRUE, deleted_at = $1 WHERE id = $2`, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// HideMessage deletes the message for the user only, it's left out of their history
+func (m *MessageModel) HideMessage(ctx context.Context, id string, userID int) error {
+	stmt := `INSERT INTO hidden_messages(user_id, message_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err := m.Pool.Exec(ctx, stmt, userID, id)
+	return err
+}
+
+// PurgeDeleted erases the content of up to limit messages deleted before t along with
+// their reactions, revisions, pins, mentions and attachments. the tombstones are kept.
+// it returns the number of purged messages and the blob keys to remove from storage
+func (m *MessageModel) PurgeDeleted(ctx context.Context, t time.Time, limit int) (int, []string, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	stmt := `
+		SELECT id FROM messages
+		WHERE is_deleted AND purged_at IS NULL AND deleted_at < $1
+		ORDER BY deleted_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`
+	rows, err := tx.Query(ctx, stmt, t, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	ids := make([]string, 0, limit)
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	keys, err := deleteMessageData(ctx, tx, ids)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stmt = `
+		UPDATE messages
+		SET content = '', content_ast = NULL, plain_text = NULL, link_preview = NULL, purged_at = $1
+		WHERE id = ANY($2)
+	`
+	_, err = tx.Exec(ctx, stmt, time.Now().UTC(), ids)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return len(ids), keys, tx.Commit(ctx)
+}
+
+// deleteMessageData deletes the reactions, revisions, pins, mentions and attachments of the
+// messages. it returns the blob keys of the deleted attachments that no other attachment uses
+func deleteMessageData(ctx context.Context, tx pgx.Tx, ids []string) ([]string, error) {
+	for _, stmt := range []string{
+		`DELETE FROM reactions WHERE message_id = ANY($1)`,
+		`DELETE FROM message_revisions WHERE message_id = ANY($1)`,
+		`DELETE FROM pinned_messages WHERE message_id = ANY($1)`,
+		`DELETE FROM message_mentions WHERE message_id = ANY($1)`,
+	} {
+		_, err := tx.Exec(ctx, stmt, ids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	deletedKeys := make([]string, 0)
+	rows, err := tx.Query(ctx, `DELETE FROM attachments WHERE message_id = ANY($1) RETURNING storage_key, thumbnail_key`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key string
+		var thumbnailKey null.String
+		err = rows.Scan(&key, &thumbnailKey)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deletedKeys = append(deletedKeys, key)
+		if thumbnailKey.Valid {
+			deletedKeys = append(deletedKeys, thumbnailKey.String)
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return unusedBlobKeys(ctx, tx, deletedKeys)
+}
+
+// unusedBlobKeys returns the keys of the deleted attachments no remaining attachment uses.
+// forwarded attachments share blobs, which are only removed with the last row using them
+func unusedBlobKeys(ctx context.Context, tx pgx.Tx, deletedKeys []string) ([]string, error) {
+	stmt := `
+		SELECT DISTINCT k FROM unnest($1::text[]) k
+		WHERE NOT EXISTS (SELECT 1 FROM attachments a WHERE a.storage_key = k OR a.thumbnail_key = k)
+	`
+	rows, err := tx.Query(ctx, stmt, deletedKeys)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(deletedKeys))
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
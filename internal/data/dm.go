@@ -3,64 +3,223 @@ package data
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"gopkg.in/guregu/null.v4"
+)
+
+var (
+	ErrNotParticipant     = errors.New("user is not a participant of the dm")
+	ErrAlreadyParticipant = errors.New("user is already a participant of the dm")
 )
 
 type DM struct {
-	id int
+	ID           int              `json:"id"`
+	Name         null.String      `json:"name"`
+	OwnerID      null.Int         `json:"owner_id"`
+	IsGroup      bool             `json:"is_group"`
+	Retention    Retention        `json:"retention"`
+	Participants []*BasicUserResp `json:"participants"`
+	// RequestStatus is set on one to one dms started as a message request by RequestedBy
+	RequestStatus null.String `json:"request_status"`
+	RequestedBy   null.Int    `json:"requested_by"`
+}
+
+func (d *DM) ParticipantIDs() []int {
+	ids := make([]int, 0, len(d.Participants))
+	for _, p := range d.Participants {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func (d *DM) HasParticipant(userID int) bool {
+	for _, p := range d.Participants {
+		if p.ID == userID {
+			return true
+		}
+	}
+	return false
 }
 
 type DMModel struct {
 	Pool *pgxpool.Pool
 }
 
-func (m *DMModel) GetDMListForUser(ctx context.Context, userID int) ([]*BasicUserResp, error) {
+type DMListItem struct {
+	ID      int         `json:"dm_id"`
+	Name    null.String `json:"name"`
+	IsGroup bool        `json:"is_group"`
+	// Participants are the participants other than the user the list belongs to
+	Participants []*BasicUserResp `json:"participants"`
+	LastMessage  MessagePreview   `json:"last_message"`
+	UnreadCount  int              `json:"unread_count"`
+}
+
+type MessagePreview struct {
+	ID        string        `json:"id"`
+	Content   string        `json:"content"`
+	User      BasicUserResp `json:"user"`
+	CreatedAt time.Time     `json:"created_at"`
+	IsDeleted bool          `json:"is_deleted"`
+}
+
+// unreadCount counts the messages of the participant row dp that are newer than its read marker
+const unreadCount = `(
+	SELECT COUNT(*) FROM ` + liveMessages + ` um
+	WHERE um.dm_id = dp.dm_id AND um.user_id <> dp.participant_id AND NOT um.is_deleted
+	AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = um.id AND h.user_id = dp.participant_id)
+	AND NOT EXISTS (
+		SELECT 1 FROM messages rm
+		WHERE rm.id = dp.last_read_message_id AND (rm.created_at, rm.id) >= (um.created_at, um.id)
+	)
+)`
+
+// GetDMListForUser returns the user's dms ordered by latest activity. one to one dms are only
+// listed while the participants are friends, even after a declined request, once a message
+// request between them is accepted or to the requester while it is pending. before is the ID of the last message of the
+// previous page's last dm
+func (m *DMModel) GetDMListForUser(ctx context.Context, userID int, before string, limit int) ([]*DMListItem, bool, error) {
+	filter := `(
+		d.is_group
+		OR d.request_status = 'accepted'
+		OR (d.request_status = 'pending' AND d.requested_by = $1)
+		OR ((d.request_status IS NULL OR d.request_status = 'declined') AND EXISTS (
+			SELECT 1 FROM dm_participants other
+			JOIN follow_relations f1 ON f1.follower_id = $1 AND f1.following_id = other.participant_id
+			JOIN follow_relations f2 ON f2.follower_id = other.participant_id AND f2.following_id = $1
+			WHERE other.dm_id = d.id AND other.participant_id <> $1
+		))
+	)`
+	return m.getDMList(ctx, filter, userID, before, limit)
+}
+
+// GetMessageRequests returns the pending message requests sent to the user, paginated like
+// GetDMListForUser
+func (m *DMModel) GetMessageRequests(ctx context.Context, userID int, before string, limit int) ([]*DMListItem, bool, error) {
+	filter := `d.request_status = 'pending' AND d.requested_by <> $1`
+	return m.getDMList(ctx, filter, userID, before, limit)
+}
+
+func (m *DMModel) getDMList(ctx context.Context, filter string, userID int, before string, limit int) ([]*DMListItem, bool, error) {
 	stmt := `
-		SELECT u.id, u.username, u.avatar
-		  FROM dm_participants AS dp1
-		  JOIN dm_participants AS dp2 ON dp1.dm_id = dp2.dm_id AND dp1.participant_id != dp2.participant_id
-		  JOIN follow_relations AS f1 ON dp1.participant_id = f1.following_id AND dp2.participant_id = f1.follower_id
-		  JOIN follow_relations AS f2 ON dp1.participant_id = f2.follower_id AND dp2.participant_id = f2.following_id
-		  JOIN users AS u ON u.id = dp2.participant_id
-		  JOIN messages AS m ON m.dm_id = dp2.dm_id
-		WHERE dp1.participant_id = $1
-		GROUP BY dp2.dm_id, u.id
-		HAVING COUNT(m.id) > 0;
-  `
+		SELECT
+			d.id, d.name, d.is_group,
+			lm.id, lm.content, lm.created_at, lm.is_deleted,
+			lu.id, lu.username, lu.avatar,
+			` + unreadCount + ` AS unread_count
+		FROM dm_participants dp
+		JOIN dms d ON d.id = dp.dm_id
+		JOIN LATERAL (
+			SELECT
+				id, CASE WHEN is_deleted THEN '' ELSE COALESCE(plain_text, content) END AS content,
+				created_at, is_deleted, user_id
+			FROM ` + liveMessages + ` m
+			WHERE dm_id = d.id
+			AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = $1)
+			ORDER BY created_at DESC, id DESC
+			LIMIT 1
+		) lm ON TRUE
+		JOIN users lu ON lu.id = lm.user_id
+		WHERE dp.participant_id = $1
+		AND ` + filter + `
+		AND ($2 = '' OR (lm.created_at, lm.id) < (SELECT created_at, id FROM messages WHERE id = $2))
+		ORDER BY lm.created_at DESC, lm.id DESC
+		LIMIT $3
+	`
 
-	users := make([]*BasicUserResp, 0)
-	rows, err := m.Pool.Query(ctx, stmt, userID)
+	rows, err := m.Pool.Query(ctx, stmt, userID, before, limit+1)
 	if err != nil {
-		switch {
-		case errors.Is(err, pgx.ErrNoRows):
-			return users, nil
-		default:
-			return nil, err
-		}
+		return nil, false, err
 	}
+	defer rows.Close()
 
+	dms := make([]*DMListItem, 0)
+	byID := make(map[int]*DMListItem)
+	dmIDs := make([]int, 0)
 	for rows.Next() {
-		var user BasicUserResp
-		err := rows.Scan(&user.ID, &user.Username, &user.Avatar)
+		dm := DMListItem{Participants: make([]*BasicUserResp, 0)}
+		err := rows.Scan(
+			&dm.ID, &dm.Name, &dm.IsGroup,
+			&dm.LastMessage.ID, &dm.LastMessage.Content, &dm.LastMessage.CreatedAt, &dm.LastMessage.IsDeleted,
+			&dm.LastMessage.User.ID, &dm.LastMessage.User.Username, &dm.LastMessage.User.Avatar,
+			&dm.UnreadCount,
+		)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		users = append(users, &user)
+		dms = append(dms, &dm)
+		byID[dm.ID] = &dm
+		dmIDs = append(dmIDs, dm.ID)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return users, nil
+	hasMore := len(dms) > limit
+	if hasMore {
+		dms = dms[:limit]
+	}
+
+	stmt = `
+		SELECT dp.dm_id, u.id, u.username, u.avatar
+		FROM dm_participants dp
+		JOIN users u ON u.id = dp.participant_id
+		WHERE dp.dm_id = ANY($1) AND dp.participant_id <> $2
+		ORDER BY u.id
+	`
+	prows, err := m.Pool.Query(ctx, stmt, dmIDs, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer prows.Close()
+
+	for prows.Next() {
+		var (
+			dmID int
+			user BasicUserResp
+		)
+		err := prows.Scan(&dmID, &user.ID, &user.Username, &user.Avatar)
+		if err != nil {
+			return nil, false, err
+		}
+		byID[dmID].Participants = append(byID[dmID].Participants, &user)
+	}
+
+	err = prows.Err()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return dms, hasMore, nil
+}
+
+// GetUnreadCounts returns the user's unread count for the dm and across all of the user's dms
+func (m *DMModel) GetUnreadCounts(ctx context.Context, dmID, userID int) (int, int, error) {
+	stmt := `
+		SELECT
+			COALESCE(SUM(sq.unread_count) FILTER (WHERE sq.dm_id = $2), 0),
+			COALESCE(SUM(sq.unread_count), 0)
+		FROM (
+			SELECT dp.dm_id, ` + unreadCount + ` AS unread_count
+			FROM dm_participants dp
+			WHERE dp.participant_id = $1
+		) sq
+	`
+
+	var count, total int
+	err := m.Pool.QueryRow(ctx, stmt, userID, dmID).Scan(&count, &total)
+	return count, total, err
 }
 
 func (m *DMModel) GetDMForParticipants(ctx context.Context, participants []int) (int, error) {
 	stmt := `SELECT dp1.dm_id
 		FROM dm_participants dp1
+		JOIN dms d ON d.id = dp1.dm_id AND NOT d.is_group
 		JOIN dm_participants dp2 ON dp1.dm_id = dp2.dm_id
 		WHERE dp1.participant_id = $1
 	  AND dp2.participant_id = $2;
@@ -106,3 +265,168 @@ func (m *DMModel) GetDMForParticipants(ctx context.Context, participants []int)
 	tx.Commit(ctx)
 	return dmID, nil
 }
+
+func (m *DMModel) GetDM(ctx context.Context, dmID int) (*DM, error) {
+	stmt := `SELECT id, name, owner_id, is_group, retention, request_status, requested_by FROM dms WHERE id = $1`
+
+	var dm DM
+	err := m.Pool.QueryRow(ctx, stmt, dmID).Scan(&dm.ID, &dm.Name, &dm.OwnerID, &dm.IsGroup, &dm.Retention, &dm.RequestStatus, &dm.RequestedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+		SELECT u.id, u.username, u.avatar
+		FROM dm_participants dp
+		JOIN users u ON u.id = dp.participant_id
+		WHERE dp.dm_id = $1
+		ORDER BY u.id
+	`
+	rows, err := m.Pool.Query(ctx, stmt, dmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dm.Participants = make([]*BasicUserResp, 0)
+	for rows.Next() {
+		var user BasicUserResp
+		err := rows.Scan(&user.ID, &user.Username, &user.Avatar)
+		if err != nil {
+			return nil, err
+		}
+		dm.Participants = append(dm.Participants, &user)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return &dm, nil
+}
+
+// CreateGroup creates a group dm owned by ownerID with the owner and the given participants as members
+func (m *DMModel) CreateGroup(ctx context.Context, name string, ownerID int, participants []int) (int, error) {
+	var dmID int
+
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return dmID, err
+	}
+	defer tx.Rollback(ctx)
+
+	stmt := `INSERT INTO dms(name, owner_id, is_group) VALUES($1, $2, TRUE) RETURNING id`
+	err = tx.QueryRow(ctx, stmt, name, ownerID).Scan(&dmID)
+	if err != nil {
+		return dmID, err
+	}
+
+	stmt = `INSERT INTO dm_participants(dm_id, participant_id) VALUES($1, $2)`
+	for _, p := range append([]int{ownerID}, participants...) {
+		_, err = tx.Exec(ctx, stmt, dmID, p)
+		if err != nil {
+			return dmID, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	return dmID, err
+}
+
+func (m *DMModel) AddParticipant(ctx context.Context, dmID, userID int) error {
+	stmt := `
+		INSERT INTO dm_participants(dm_id, participant_id)
+		SELECT $1, $2
+		WHERE NOT EXISTS (
+			SELECT 1 FROM dm_participants WHERE dm_id = $1 AND participant_id = $2
+		)
+	`
+	tag, err := m.Pool.Exec(ctx, stmt, dmID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAlreadyParticipant
+	}
+	return nil
+}
+
+func (m *DMModel) RemoveParticipant(ctx context.Context, dmID, userID int) error {
+	stmt := `DELETE FROM dm_participants WHERE dm_id = $1 AND participant_id = $2`
+	tag, err := m.Pool.Exec(ctx, stmt, dmID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotParticipant
+	}
+	return nil
+}
+
+type ReadReceipt struct {
+	DmID      int    `json:"dm_id"`
+	UserID    int    `json:"user_id"`
+	MessageID string `json:"message_id"`
+}
+
+// MarkRead moves the user's read marker to the message. the marker only moves forward,
+// so marking an older message than the current marker is a no-op
+func (m *DMModel) MarkRead(ctx context.Context, dmID, userID int, messageID string) error {
+	stmt := `
+		UPDATE dm_participants dp SET last_read_message_id = msg.id
+		FROM messages msg
+		WHERE dp.dm_id = $1 AND dp.participant_id = $2
+		AND msg.id = $3 AND msg.dm_id = dp.dm_id
+		AND NOT EXISTS (
+			SELECT 1 FROM messages cur
+			WHERE cur.id = dp.last_read_message_id
+			AND (cur.created_at, cur.id) >= (msg.created_at, msg.id)
+		)
+	`
+	_, err := m.Pool.Exec(ctx, stmt, dmID, userID, messageID)
+	return err
+}
+
+func (m *DMModel) GetReadReceipt(ctx context.Context, dmID, userID int) (*ReadReceipt, error) {
+	stmt := `SELECT last_read_message_id FROM dm_participants WHERE dm_id = $1 AND participant_id = $2`
+
+	var messageID null.String
+	err := m.Pool.QueryRow(ctx, stmt, dmID, userID).Scan(&messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReadReceipt{DmID: dmID, UserID: userID, MessageID: messageID.String}, nil
+}
+
+// GetReadReceipts returns the read markers of every participant except userID
+func (m *DMModel) GetReadReceipts(ctx context.Context, dmID, userID int) ([]*ReadReceipt, error) {
+	stmt := `
+		SELECT participant_id, last_read_message_id FROM dm_participants
+		WHERE dm_id = $1 AND participant_id <> $2 AND last_read_message_id IS NOT NULL
+	`
+
+	rows, err := m.Pool.Query(ctx, stmt, dmID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := make([]*ReadReceipt, 0)
+	for rows.Next() {
+		receipt := ReadReceipt{DmID: dmID}
+		err := rows.Scan(&receipt.UserID, &receipt.MessageID)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, &receipt)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return receipts, nil
+}
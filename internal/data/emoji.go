@@ -0,0 +1,274 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kickbu2towski/brb-api/internal/richtext"
+)
+
+// MaxEmojiPerUser is the number of custom emoji a user can upload
+const MaxEmojiPerUser = 50
+
+var (
+	ErrInvalidEmojiName   = errors.New("name must be 2 to 32 lowercase letters, digits or underscores")
+	ErrDuplicateEmojiName = errors.New("you already have an emoji with this name")
+	ErrTooManyEmoji       = errors.New("you have reached the maximum number of custom emoji")
+)
+
+// uniqueViolation is the postgres error code for a violated unique constraint
+const uniqueViolation = "23505"
+
+var emojiNameRx = regexp.MustCompile(`^[a-z0-9_]{2,32}$`)
+
+// emojiReactionPrefix prefixes the emoji ID in reactions with a custom emoji
+const emojiReactionPrefix = "emoji:"
+
+// CustomEmoji is an image uploaded by a user to be used as :name: in their messages and as
+// a reaction. emoji are owned by users, names are unique per owner
+type CustomEmoji struct {
+	ID         string    `json:"id"`
+	OwnerID    int       `json:"owner_id"`
+	Name       string    `json:"name"`
+	MimeType   string    `json:"mime_type"`
+	Size       int64     `json:"size"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	Animated   bool      `json:"animated"`
+	StorageKey string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func ValidEmojiName(name string) bool {
+	return emojiNameRx.MatchString(name)
+}
+
+// EmojiReaction returns the reaction with the custom emoji
+func EmojiReaction(id string) string {
+	return emojiReactionPrefix + id
+}
+
+// ParseEmojiReaction returns the custom emoji ID of a reaction made with EmojiReaction
+func ParseEmojiReaction(reaction string) (string, bool) {
+	if !strings.HasPrefix(reaction, emojiReactionPrefix) {
+		return "", false
+	}
+	id := strings.TrimPrefix(reaction, emojiReactionPrefix)
+	return id, id != ""
+}
+
+// ParseEmojiShortcode returns the name of a :name: shortcode
+func ParseEmojiShortcode(s string) (string, bool) {
+	if len(s) < 2 || s[0] != ':' || s[len(s)-1] != ':' {
+		return "", false
+	}
+	name := s[1 : len(s)-1]
+	return name, ValidEmojiName(name)
+}
+
+type EmojiModel struct {
+	Pool *pgxpool.Pool
+}
+
+const emojiColumns = `id, owner_id, name, mime_type, size, width, height, animated, storage_key, created_at`
+
+func scanEmoji(row pgx.Row) (*CustomEmoji, error) {
+	var e CustomEmoji
+	err := row.Scan(&e.ID, &e.OwnerID, &e.Name, &e.MimeType, &e.Size, &e.Width, &e.Height, &e.Animated, &e.StorageKey, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Insert stores the emoji, its image must already be stored under its StorageKey
+func (m *EmojiModel) Insert(ctx context.Context, e *CustomEmoji) error {
+	if !ValidEmojiName(e.Name) {
+		return ErrInvalidEmojiName
+	}
+
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// locking the owner serializes concurrent uploads so the cap and unique names hold
+	_, err = tx.Exec(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, e.OwnerID)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	var nameTaken bool
+	stmt := `SELECT COUNT(*), COALESCE(bool_or(name = $2), FALSE) FROM custom_emoji WHERE owner_id = $1`
+	err = tx.QueryRow(ctx, stmt, e.OwnerID, e.Name).Scan(&count, &nameTaken)
+	if err != nil {
+		return err
+	}
+	if nameTaken {
+		return ErrDuplicateEmojiName
+	}
+	if count >= MaxEmojiPerUser {
+		return ErrTooManyEmoji
+	}
+
+	e.CreatedAt = time.Now().UTC()
+	stmt = `
+		INSERT INTO custom_emoji(` + emojiColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	args := []any{e.ID, e.OwnerID, e.Name, e.MimeType, e.Size, e.Width, e.Height, e.Animated, e.StorageKey, e.CreatedAt}
+	_, err = tx.Exec(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (m *EmojiModel) Get(ctx context.Context, id string) (*CustomEmoji, error) {
+	stmt := `SELECT ` + emojiColumns + ` FROM custom_emoji WHERE id = $1`
+	return scanEmoji(m.Pool.QueryRow(ctx, stmt, id))
+}
+
+// GetByName returns the user's emoji with the name
+func (m *EmojiModel) GetByName(ctx context.Context, ownerID int, name string) (*CustomEmoji, error) {
+	stmt := `SELECT ` + emojiColumns + ` FROM custom_emoji WHERE owner_id = $1 AND name = $2`
+	return scanEmoji(m.Pool.QueryRow(ctx, stmt, ownerID, name))
+}
+
+// GetForUser returns the user's emoji ordered by name
+func (m *EmojiModel) GetForUser(ctx context.Context, ownerID int) ([]*CustomEmoji, error) {
+	stmt := `SELECT ` + emojiColumns + ` FROM custom_emoji WHERE owner_id = $1 ORDER BY name`
+	rows, err := m.Pool.Query(ctx, stmt, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emoji := make([]*CustomEmoji, 0)
+	for rows.Next() {
+		e, err := scanEmoji(rows)
+		if err != nil {
+			return nil, err
+		}
+		emoji = append(emoji, e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return emoji, nil
+}
+
+// Rename changes the name of the user's emoji. messages already using it keep the old :name:
+func (m *EmojiModel) Rename(ctx context.Context, id string, ownerID int, name string) (*CustomEmoji, error) {
+	if !ValidEmojiName(name) {
+		return nil, ErrInvalidEmojiName
+	}
+
+	var nameTaken bool
+	stmt := `SELECT EXISTS (SELECT 1 FROM custom_emoji WHERE owner_id = $1 AND name = $2 AND id <> $3)`
+	err := m.Pool.QueryRow(ctx, stmt, ownerID, name, id).Scan(&nameTaken)
+	if err != nil {
+		return nil, err
+	}
+	if nameTaken {
+		return nil, ErrDuplicateEmojiName
+	}
+
+	// a concurrent rename or upload can still take the name, which the unique index rejects
+	stmt = `UPDATE custom_emoji SET name = $1 WHERE id = $2 AND owner_id = $3 RETURNING ` + emojiColumns
+	e, err := scanEmoji(m.Pool.QueryRow(ctx, stmt, name, id, ownerID))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return nil, ErrDuplicateEmojiName
+	}
+	return e, err
+}
+
+// Delete deletes the user's emoji and the reactions made with it. it returns the storage
+// key of the image, which the caller should remove from storage, and the removed reactions
+func (m *EmojiModel) Delete(ctx context.Context, id string, ownerID int) (string, []*ReactionPayload, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var key string
+	stmt := `DELETE FROM custom_emoji WHERE id = $1 AND owner_id = $2 RETURNING storage_key`
+	err = tx.QueryRow(ctx, stmt, id, ownerID).Scan(&key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	stmt = `
+		DELETE FROM reactions r USING messages m, users u
+		WHERE r.reaction = $1 AND m.id = r.message_id AND u.id = r.user_id
+		RETURNING m.dm_id, r.message_id, u.id, u.username, u.avatar
+	`
+	rows, err := tx.Query(ctx, stmt, EmojiReaction(id))
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	removed := make([]*ReactionPayload, 0)
+	for rows.Next() {
+		p := ReactionPayload{Reaction: EmojiReaction(id), Removed: true}
+		err = rows.Scan(&p.DmID, &p.MessageID, &p.User.ID, &p.User.Username, &p.User.Avatar)
+		if err != nil {
+			return "", nil, err
+		}
+		removed = append(removed, &p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, removed, tx.Commit(ctx)
+}
+
+// ResolveContent turns the :name: shortcodes in the content of a message into emoji nodes
+// for the sender's custom emoji with those names
+func (m *EmojiModel) ResolveContent(ctx context.Context, userID int, nodes []*richtext.Node) ([]*richtext.Node, error) {
+	names := richtext.EmojiNames(nodes)
+	if len(names) == 0 {
+		return nodes, nil
+	}
+
+	rows, err := m.Pool.Query(ctx, `SELECT name, id FROM custom_emoji WHERE owner_id = $1 AND name = ANY($2)`, userID, names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emoji := make(map[string]string)
+	for rows.Next() {
+		var name, id string
+		err := rows.Scan(&name, &id)
+		if err != nil {
+			return nil, err
+		}
+		emoji[name] = id
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return richtext.ReplaceEmoji(nodes, emoji), nil
+}
@@ -1,5 +1,7 @@
 package data
 
+import "gopkg.in/guregu/null.v4"
+
 type Event struct {
 	Name        string         `json:"name"`
 	UserID      int            `json:"user_id"`
@@ -7,3 +9,137 @@ type Event struct {
 	BroadcastTo []int          `json:"broadcastTo"`
 	Payload     map[string]any `json:"payload"`
 }
+
+const (
+	EventFollowed      = "Followed"
+	EventUnfollowed    = "Unfollowed"
+	EventBecameFriends = "BecameFriends"
+)
+
+type FollowedPayload struct {
+	Follower    BasicUserResp `json:"follower"`
+	FollowingID int           `json:"following_id"`
+}
+
+type UnfollowedPayload struct {
+	Follower    BasicUserResp `json:"follower"`
+	FollowingID int           `json:"following_id"`
+	WasFriends  bool          `json:"was_friends"`
+}
+
+type BecameFriendsPayload struct {
+	Friend BasicUserResp `json:"friend"`
+}
+
+const (
+	EventMemberAdded   = "MemberAdded"
+	EventMemberRemoved = "MemberRemoved"
+)
+
+type MemberPayload struct {
+	DmID int           `json:"dm_id"`
+	User BasicUserResp `json:"user"`
+	By   BasicUserResp `json:"by"`
+}
+
+const EventRead = "Read"
+
+const EventUnreadCount = "UnreadCount"
+
+type UnreadCountPayload struct {
+	DmID             int `json:"dm_id"`
+	UnreadCount      int `json:"unread_count"`
+	TotalUnreadCount int `json:"total_unread_count"`
+}
+
+const EventTyping = "Typing"
+
+type TypingPayload struct {
+	DmID     int  `json:"dm_id"`
+	UserID   int  `json:"user_id"`
+	IsTyping bool `json:"is_typing"`
+}
+
+const EventMessageUpdated = "MessageUpdated"
+
+const EventPin = "Pin"
+
+type PinPayload struct {
+	DmID      int           `json:"dm_id"`
+	MessageID string        `json:"message_id"`
+	IsPinned  bool          `json:"is_pinned"`
+	By        BasicUserResp `json:"by"`
+}
+
+const EventScheduled = "Scheduled"
+
+type ScheduledPayload struct {
+	ClientNonce null.String       `json:"client_nonce"`
+	Message     *ScheduledMessage `json:"message"`
+}
+
+const EventRetentionChanged = "RetentionChanged"
+
+type RetentionPayload struct {
+	DmID      int           `json:"dm_id"`
+	Retention Retention     `json:"retention"`
+	By        BasicUserResp `json:"by"`
+}
+
+const EventMessagesExpired = "MessagesExpired"
+
+type MessagesExpiredPayload struct {
+	DmID       int      `json:"dm_id"`
+	MessageIDs []string `json:"message_ids"`
+}
+
+const EventMention = "Mention"
+
+type MentionPayload struct {
+	DmID    int          `json:"dm_id"`
+	Message *MessageResp `json:"message"`
+}
+
+const EventMessageRequest = "MessageRequest"
+
+type MessageRequestPayload struct {
+	DmID   int    `json:"dm_id"`
+	Status string `json:"status"`
+}
+
+const EventMessageHidden = "MessageHidden"
+
+type MessageHiddenPayload struct {
+	DmID      int    `json:"dm_id"`
+	MessageID string `json:"message_id"`
+}
+
+const EventReaction = "Reaction"
+
+// ReactionPayload is a reaction added to or removed from a message
+type ReactionPayload struct {
+	DmID      int           `json:"dm_id"`
+	MessageID string        `json:"message_id"`
+	Reaction  string        `json:"reaction"`
+	User      BasicUserResp `json:"user"`
+	Removed   bool          `json:"removed"`
+}
+
+// EventExportCompleted is sent when a background export is ready or failed
+const EventExportCompleted = "ExportCompleted"
+
+type ExportPayload struct {
+	Export *Export `json:"export"`
+}
+
+// EventError is sent to the client whose event was rejected, the connection stays open
+const EventError = "Error"
+
+// ErrorPayload tells the client which of its events was rejected and why. the event is
+// identified by its client nonce or the ID of the message it refers to
+type ErrorPayload struct {
+	EventType   string      `json:"event_type"`
+	ClientNonce null.String `json:"client_nonce"`
+	MessageID   null.String `json:"message_id"`
+	Error       string      `json:"error"`
+}
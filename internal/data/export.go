@@ -0,0 +1,251 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gopkg.in/guregu/null.v4"
+)
+
+// export formats
+const (
+	ExportJSON = "json"
+	ExportHTML = "html"
+	ExportText = "txt"
+)
+
+// export statuses
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// MaxPendingExports is the number of background exports a user can have running at once
+const MaxPendingExports = 3
+
+// pendingExportTimeout is how long an export can stay pending before it's assumed to have
+// been abandoned, e.g. by a restart, and no longer counts as running
+const pendingExportTimeout = time.Hour
+
+var (
+	ErrInvalidExportFormat = errors.New("format must be one of json, html and txt")
+	ErrTooManyExports      = errors.New("you have reached the maximum number of exports in progress")
+)
+
+func ValidExportFormat(format string) bool {
+	return format == ExportJSON || format == ExportHTML || format == ExportText
+}
+
+// exportBatch is the number of messages fetched from the export cursor at a time
+const exportBatch = 500
+
+// ExportedMessage is a message with its edit history, as written to exports
+type ExportedMessage struct {
+	*MessageResp
+	Revisions []*MessageRevision `json:"revisions"`
+}
+
+// CountMessages counts the messages of the dm visible to viewerID
+func (m *MessageModel) CountMessages(ctx context.Context, dmID, viewerID int) (int, error) {
+	stmt := `
+		SELECT COUNT(*) FROM ` + liveMessages + ` m
+		WHERE m.dm_id = $1
+		AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = $2)
+	`
+	var count int
+	err := m.Pool.QueryRow(ctx, stmt, dmID, viewerID).Scan(&count)
+	return count, err
+}
+
+// ExportMessages calls fn with every message of the dm visible to viewerID, oldest first.
+// the messages are read from a cursor in batches so the history is never held in memory,
+// and the transaction's snapshot keeps the export consistent with itself
+func (m *MessageModel) ExportMessages(ctx context.Context, dmID, viewerID int, fn func(*ExportedMessage) error) error {
+	tx, err := m.Pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	stmt := `
+		DECLARE export_messages NO SCROLL CURSOR FOR
+		SELECT` + messageColumns + `,
+		(
+			SELECT COALESCE(json_agg(json_build_object(
+				'id', mr.id,
+				'message_id', mr.message_id,
+				'content', mr.content,
+				'edited_at', mr.edited_at
+			) ORDER BY mr.edited_at, mr.id), '[]'::json)
+			FROM message_revisions mr WHERE mr.message_id = m.id AND NOT m.is_deleted
+		) AS revisions` + messageJoins + `
+		WHERE m.dm_id = $1
+		AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = $2)
+		ORDER BY m.created_at, m.id
+	`
+	_, err = tx.Exec(ctx, stmt, dmID, viewerID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		rows, err := tx.Query(ctx, `FETCH `+strconv.Itoa(exportBatch)+` FROM export_messages`)
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		for rows.Next() {
+			n++
+			var e ExportedMessage
+			e.MessageResp, err = scanMessage(rows, &e.Revisions)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			err = fn(&e)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		if n < exportBatch {
+			break
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Export is an export of a dm generated in the background for a user
+type Export struct {
+	ID          string    `json:"id"`
+	UserID      int       `json:"user_id"`
+	DmID        int       `json:"dm_id"`
+	Format      string    `json:"format"`
+	Status      string    `json:"status"`
+	StorageKey  string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	CompletedAt null.Time `json:"completed_at"`
+	// DownloadURL is set once the export is ready
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+type ExportModel struct {
+	Pool *pgxpool.Pool
+}
+
+const exportColumns = `id, user_id, dm_id, format, status, storage_key, created_at, completed_at`
+
+// Insert stores the export as pending and reports whether it was inserted. when the user
+// already has a pending export of the dm in the format nothing is inserted and e is filled
+// with the existing export instead
+func (m *ExportModel) Insert(ctx context.Context, e *Export) (bool, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// locking the user serializes concurrent exports so the cap holds
+	_, err = tx.Exec(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, e.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	since := time.Now().UTC().Add(-pendingExportTimeout)
+	stmt := `
+		SELECT ` + exportColumns + ` FROM exports
+		WHERE user_id = $1 AND dm_id = $2 AND format = $3 AND status = 'pending' AND created_at > $4
+		ORDER BY created_at DESC
+		LIMIT 1
+	`
+	err = tx.QueryRow(ctx, stmt, e.UserID, e.DmID, e.Format, since).Scan(
+		&e.ID, &e.UserID, &e.DmID, &e.Format, &e.Status, &e.StorageKey, &e.CreatedAt, &e.CompletedAt,
+	)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	}
+
+	var pending int
+	stmt = `SELECT COUNT(*) FROM exports WHERE user_id = $1 AND status = 'pending' AND created_at > $2`
+	err = tx.QueryRow(ctx, stmt, e.UserID, since).Scan(&pending)
+	if err != nil {
+		return false, err
+	}
+	if pending >= MaxPendingExports {
+		return false, ErrTooManyExports
+	}
+
+	e.Status = ExportPending
+	e.CreatedAt = time.Now().UTC()
+	stmt = `INSERT INTO exports(` + exportColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err = tx.Exec(ctx, stmt, e.ID, e.UserID, e.DmID, e.Format, e.Status, e.StorageKey, e.CreatedAt, e.CompletedAt)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// Get returns the user's export
+func (m *ExportModel) Get(ctx context.Context, id string, userID int) (*Export, error) {
+	var e Export
+	stmt := `SELECT ` + exportColumns + ` FROM exports WHERE id = $1 AND user_id = $2`
+	err := m.Pool.QueryRow(ctx, stmt, id, userID).Scan(
+		&e.ID, &e.UserID, &e.DmID, &e.Format, &e.Status, &e.StorageKey, &e.CreatedAt, &e.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Complete records the final status of the export
+func (m *ExportModel) Complete(ctx context.Context, e *Export, status string) error {
+	e.Status = status
+	e.CompletedAt = null.TimeFrom(time.Now().UTC())
+	_, err := m.Pool.Exec(ctx, `UPDATE exports SET status = $1, completed_at = $2 WHERE id = $3`, e.Status, e.CompletedAt, e.ID)
+	return err
+}
+
+// DeleteBefore deletes the exports created before t and returns their storage keys, which
+// the caller should remove from storage
+func (m *ExportModel) DeleteBefore(ctx context.Context, t time.Time) ([]string, error) {
+	rows, err := m.Pool.Query(ctx, `DELETE FROM exports WHERE created_at < $1 RETURNING storage_key`, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		err := rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
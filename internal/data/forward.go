@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gopkg.in/guregu/null.v4"
+)
+
+var ErrCannotForward = errors.New("deleted and system messages cannot be forwarded")
+
+// ForwardedFrom attributes a forwarded message to the message it was originally sent as
+type ForwardedFrom struct {
+	MessageID string        `json:"message_id"`
+	DmID      int           `json:"dm_id"`
+	User      BasicUserResp `json:"user"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// ForwardMessage copies the message into the dm as a message of userID and reports whether
+// it was inserted, like InsertMessage. forwarding a forwarded message keeps the original
+// attribution, and attachments are copied as new rows referencing the same blobs
+func (m *MessageModel) ForwardMessage(ctx context.Context, sourceID string, dmID, userID int, nonce null.String) (string, bool, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var isDeleted, isSystem bool
+	stmt := `SELECT is_deleted, is_system FROM ` + liveMessages + ` m WHERE id = $1`
+	err = tx.QueryRow(ctx, stmt, sourceID).Scan(&isDeleted, &isSystem)
+	if err != nil {
+		return "", false, err
+	}
+	if isDeleted || isSystem {
+		return "", false, ErrCannotForward
+	}
+
+	err = checkRequestLimit(ctx, tx, dmID, userID, nonce)
+	if err != nil {
+		return "", false, err
+	}
+
+	id, err := NewID()
+	if err != nil {
+		return "", false, err
+	}
+	createdAt := time.Now().UTC()
+	expiresAt, err := messageExpiry(ctx, tx, dmID, createdAt)
+	if err != nil {
+		return "", false, err
+	}
+
+	stmt = `
+		INSERT INTO messages(
+			id, content, dm_id, user_id, created_at, client_nonce, expires_at, content_ast, plain_text,
+			link_preview, forwarded_from_message_id, forwarded_from_dm_id, forwarded_from_user_id,
+			forwarded_from_created_at
+		)
+		SELECT
+			$1, content, $2, $3, $4, $5, $6, content_ast, plain_text, link_preview,
+			COALESCE(forwarded_from_message_id, id),
+			COALESCE(forwarded_from_dm_id, dm_id),
+			COALESCE(forwarded_from_user_id, user_id),
+			COALESCE(forwarded_from_created_at, created_at)
+		FROM messages WHERE id = $7
+		ON CONFLICT (dm_id, user_id, client_nonce) WHERE client_nonce IS NOT NULL DO NOTHING
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, stmt, id, dmID, userID, createdAt, nonce, expiresAt, sourceID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		stmt = `SELECT id FROM messages WHERE dm_id = $1 AND user_id = $2 AND client_nonce = $3`
+		err = tx.QueryRow(ctx, stmt, dmID, userID, nonce).Scan(&id)
+		return id, false, err
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	rows, err := tx.Query(ctx, `SELECT id FROM attachments WHERE message_id = $1 ORDER BY created_at, id`, sourceID)
+	if err != nil {
+		return "", false, err
+	}
+	attachmentIDs := make([]string, 0)
+	for rows.Next() {
+		var attachmentID string
+		err = rows.Scan(&attachmentID)
+		if err != nil {
+			rows.Close()
+			return "", false, err
+		}
+		attachmentIDs = append(attachmentIDs, attachmentID)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, attachmentID := range attachmentIDs {
+		copyID, err := NewID()
+		if err != nil {
+			return "", false, err
+		}
+		stmt = `
+			INSERT INTO attachments(id, user_id, message_id, filename, mime_type, size, storage_key, width, height, thumbnail_key)
+			SELECT $1, $2, $3, filename, mime_type, size, storage_key, width, height, thumbnail_key
+			FROM attachments WHERE id = $4
+		`
+		_, err = tx.Exec(ctx, stmt, copyID, userID, id, attachmentID)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	return id, true, tx.Commit(ctx)
+}
@@ -0,0 +1,156 @@
+package data
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/kickbu2towski/brb-api/internal/richtext"
+)
+
+// Mention is a span of message content mentioning a user. Start and End are offsets in
+// UTF-16 code units into the plain text of the content, the concatenated text of its
+// ContentAST, so clients can find them in the nodes they render
+type Mention struct {
+	UserID int `json:"user_id"`
+	Start  int `json:"start"`
+	End    int `json:"end"`
+}
+
+// ParseMentions finds the @username and @userID mentions of the participants in the text
+// nodes of the parsed content. code and link targets are never searched. usernames can
+// contain spaces, so the longest username matching after an @ wins
+func ParseMentions(nodes []*richtext.Node, participants []*BasicUserResp) []*Mention {
+	s := mentionScanner{participants: participants, mentions: make([]*Mention, 0)}
+	s.walk(nodes)
+	return s.mentions
+}
+
+// mentionScanner walks the nodes in plain text order, keeping track of the offset
+type mentionScanner struct {
+	participants []*BasicUserResp
+	mentions     []*Mention
+	offset       int
+	prev         rune
+}
+
+func (s *mentionScanner) walk(nodes []*richtext.Node) {
+	for _, n := range nodes {
+		if n.Type == richtext.NodeText {
+			s.scan(n.Text)
+		} else if n.Text != "" {
+			s.offset += utf16Len(n.Text)
+			s.prev, _ = utf8.DecodeLastRuneInString(n.Text)
+		}
+		s.walk(n.Children)
+	}
+}
+
+func (s *mentionScanner) scan(text string) {
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r == '@' && !isWordRune(s.prev) {
+			userID, n := matchMention(text[i+size:], s.participants)
+			if n > 0 {
+				mention := text[i : i+size+n]
+				end := s.offset + utf16Len(mention)
+				s.mentions = append(s.mentions, &Mention{UserID: userID, Start: s.offset, End: end})
+
+				s.prev, _ = utf8.DecodeLastRuneInString(mention)
+				s.offset = end
+				i += len(mention)
+				continue
+			}
+		}
+
+		s.prev = r
+		s.offset += utf16Len(string(r))
+		i += size
+	}
+}
+
+// matchMention returns the participant mentioned at the start of s and the length of the
+// mention in bytes, or a length of 0 when s doesn't start with a mention
+func matchMention(s string, participants []*BasicUserResp) (int, int) {
+	var userID, length int
+	for _, p := range participants {
+		n := len(p.Username)
+		if n > length && n <= len(s) && strings.EqualFold(s[:n], p.Username) && isMentionEnd(s[n:]) {
+			userID, length = p.ID, n
+		}
+	}
+	if length > 0 {
+		return userID, length
+	}
+
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	if n == 0 || !isMentionEnd(s[n:]) {
+		return 0, 0
+	}
+	id, err := strconv.Atoi(s[:n])
+	if err != nil {
+		return 0, 0
+	}
+	for _, p := range participants {
+		if p.ID == id {
+			return id, n
+		}
+	}
+	return 0, 0
+}
+
+func isMentionEnd(rest string) bool {
+	r, _ := utf8.DecodeRuneInString(rest)
+	return rest == "" || !isWordRune(r)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// MentionedUserIDs returns the distinct users mentioned in the spans
+func MentionedUserIDs(mentions []*Mention) []int {
+	ids := make([]int, 0, len(mentions))
+	seen := make(map[int]bool)
+	for _, m := range mentions {
+		if !seen[m.UserID] {
+			seen[m.UserID] = true
+			ids = append(ids, m.UserID)
+		}
+	}
+	return ids
+}
+
+// insertMentions stores the mention spans of the message
+func insertMentions(ctx context.Context, tx pgx.Tx, messageID string, mentions []*Mention) error {
+	if len(mentions) == 0 {
+		return nil
+	}
+
+	userIDs := make([]int, 0, len(mentions))
+	starts := make([]int, 0, len(mentions))
+	ends := make([]int, 0, len(mentions))
+	for _, m := range mentions {
+		userIDs = append(userIDs, m.UserID)
+		starts = append(starts, m.Start)
+		ends = append(ends, m.End)
+	}
+
+	stmt := `
+		INSERT INTO message_mentions(message_id, user_id, start_offset, end_offset)
+		SELECT $1, unnest($2::integer[]), unnest($3::integer[]), unnest($4::integer[])
+	`
+	_, err := tx.Exec(ctx, stmt, messageID, userIDs, starts, ends)
+	return err
+}
@@ -2,9 +2,14 @@ package data
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
+	"unicode/utf8"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kickbu2towski/brb-api/internal/richtext"
 	"gopkg.in/guregu/null.v4"
 )
 
@@ -17,72 +22,319 @@ type Message struct {
 	IsDeleted bool        `json:"is_deleted"`
 	IsEdited  bool        `json:"is_edited"`
 	ReplyToID null.String `json:"reply_to_id"`
+	IsSystem  bool        `json:"is_system"`
+	DeletedAt null.Time   `json:"deleted_at"`
+	// AttachmentIDs are the uploaded attachments to link when creating the message
+	AttachmentIDs []string `json:"attachment_ids,omitempty"`
+	// ClientNonce is chosen by the sending client to make retries idempotent and to
+	// reconcile its optimistic message with the stored one
+	ClientNonce null.String `json:"client_nonce"`
+	// ExpiresAt is when the message disappears under the dm's retention
+	ExpiresAt null.Time  `json:"expires_at"`
+	Mentions  []*Mention `json:"mentions"`
+	// ContentAST is the content parsed as rich text, clients render it instead of the raw content
+	ContentAST []*richtext.Node `json:"content_ast"`
+	// PlainText is the content without markup, used for search and previews
+	PlainText null.String `json:"plain_text"`
+}
+
+// MaxContentLength is the number of characters the content of a message can have
+const MaxContentLength = 4000
+
+var ErrContentTooLong = fmt.Errorf("content must not be longer than %d characters", MaxContentLength)
+
+// ParseContent parses the content into ContentAST and PlainText. content with unsupported
+// markup is rejected with an error wrapping richtext.ErrDisallowed
+func (m *Message) ParseContent() error {
+	nodes, err := parseContent(m.Content)
+	if err != nil {
+		return err
+	}
+	m.ContentAST = nodes
+	m.PlainText = null.StringFrom(richtext.PlainText(nodes))
+	return nil
+}
+
+// parseContent checks the length of the content before parsing it, so overly long content
+// is never parsed
+func parseContent(content string) ([]*richtext.Node, error) {
+	if utf8.RuneCountInString(content) > MaxContentLength {
+		return nil, ErrContentTooLong
+	}
+	return richtext.Parse(content)
 }
 
 type MessageResp struct {
 	Message
-	User      BasicUserResp    `json:"user"`
-	Reactions map[string][]int `json:"reactions"`
+	User        BasicUserResp    `json:"user"`
+	Reactions   map[string][]int `json:"reactions"`
+	Attachments []*Attachment    `json:"attachments"`
+	LinkPreview *LinkPreview     `json:"link_preview"`
+	ReplyTo     *ReplyPreview    `json:"reply_to"`
+	// ForwardedFrom is set when the message was forwarded from another dm
+	ForwardedFrom *ForwardedFrom `json:"forwarded_from"`
 }
 
+// ReplyPreview is the part of the replied to message shown with a reply. the content of
+// deleted messages is left out, and messages removed by retention only keep their ID
+type ReplyPreview struct {
+	ID          string        `json:"id"`
+	User        BasicUserResp `json:"user"`
+	Content     string        `json:"content"`
+	IsTruncated bool          `json:"is_truncated"`
+	IsDeleted   bool          `json:"is_deleted"`
+}
+
+var ErrInvalidReply = errors.New("replied to message must be in the same dm")
+
+var ErrEmptyMessage = errors.New("message must have content or attachments")
+
 type MessageModel struct {
 	Pool *pgxpool.Pool
 }
 
-func (m *MessageModel) GetMessages(ctx context.Context, dmID int) ([]*MessageResp, error) {
-	stmt := `
-	  SELECT 
-		sq3.id, sq3.content, sq3.dm_id, sq3.created_at,
-		sq3.is_deleted, sq3.is_edited, sq3.reply_to_id,
-		sq3.user_id, sq3.username, sq3.avatar, sq3.reactions
-		FROM (
-			SELECT m.id, m.content, m.dm_id, m.created_at, 
-			m.is_deleted, m.is_edited, m.reply_to_id,
-			m.user_id, u.username, u.avatar, reactions
-			FROM messages m
-			JOIN users u ON m.user_id = u.id
-			LEFT JOIN (
-				SELECT message_id, json_object_agg(reaction, user_ids) AS reactions FROM
-				(SELECT message_id, reaction, json_agg(r.user_id) AS user_ids FROM reactions  r
-				GROUP BY reaction, message_id) AS sq1 GROUP BY message_id 
-			) sq2 ON sq2.message_id = m.id 
-			WHERE dm_id = $1
-			ORDER BY created_at DESC
-			LIMIT 50
-		) AS sq3
-		ORDER BY sq3.created_at ASC
-  `
+// messageColumns are the columns scanned by scanMessage, selected from messageJoins
+const messageColumns = `
+		m.id,
+		m.content,
+		m.dm_id,
+		m.created_at,
+		m.is_deleted,
+		m.is_edited,
+		m.reply_to_id,
+		m.is_system,
+		m.deleted_at,
+		m.client_nonce,
+		m.expires_at,
+		m.content_ast,
+		m.plain_text,
+		u.id AS user_id,
+		u.username,
+		u.avatar,
+		sq2.reactions,
+		(
+			SELECT COALESCE(json_agg(json_build_object(
+				'id', a.id,
+				'user_id', a.user_id,
+				'message_id', a.message_id,
+				'filename', a.filename,
+				'mime_type', a.mime_type,
+				'size', a.size,
+				'width', a.width,
+				'height', a.height,
+				'has_thumbnail', a.thumbnail_key IS NOT NULL,
+				'created_at', a.created_at
+			) ORDER BY a.created_at, a.id), '[]'::json)
+			FROM attachments a WHERE a.message_id = m.id
+		) AS attachments,
+		m.link_preview,
+		CASE WHEN m.reply_to_id IS NOT NULL THEN COALESCE((
+			SELECT json_build_object(
+				'id', rm.id,
+				'user', json_build_object('id', ru.id, 'username', ru.username, 'avatar', ru.avatar),
+				'content', CASE WHEN rm.is_deleted THEN '' ELSE left(COALESCE(rm.plain_text, rm.content), 100) END,
+				'is_truncated', NOT rm.is_deleted AND char_length(COALESCE(rm.plain_text, rm.content)) > 100,
+				'is_deleted', rm.is_deleted
+			)
+			FROM ` + liveMessages + ` rm
+			JOIN users ru ON ru.id = rm.user_id
+			WHERE rm.id = m.reply_to_id
+		), json_build_object('id', m.reply_to_id, 'content', '', 'is_truncated', false, 'is_deleted', true)) END AS reply_to,
+		(
+			SELECT COALESCE(json_agg(json_build_object(
+				'user_id', mm.user_id,
+				'start', mm.start_offset,
+				'end', mm.end_offset
+			) ORDER BY mm.start_offset), '[]'::json)
+			FROM message_mentions mm WHERE mm.message_id = m.id
+		) AS mentions,
+		(
+			SELECT json_build_object(
+				'message_id', m.forwarded_from_message_id,
+				'dm_id', m.forwarded_from_dm_id,
+				'user', json_build_object('id', fu.id, 'username', fu.username, 'avatar', fu.avatar),
+				'created_at', m.forwarded_from_created_at
+			)
+			FROM users fu WHERE fu.id = m.forwarded_from_user_id
+		) AS forwarded_from
+`
 
-	messages := make([]*MessageResp, 0)
-	rows, err := m.Pool.Query(ctx, stmt, dmID)
+// messageJoins joins a message (aliased as m) with its author and reactions
+const messageJoins = `
+	FROM ` + liveMessages + ` m
+	JOIN users u ON u.id = m.user_id
+	LEFT JOIN (
+		SELECT message_id, json_object_agg(reaction, user_ids) AS reactions FROM
+			(SELECT r.message_id, r.reaction, json_agg(r.user_id) AS user_ids FROM reactions r
+			  GROUP BY reaction, message_id) sq1 GROUP BY message_id
+	) sq2 ON m.id = sq2.message_id
+`
+
+const messageSelect = `SELECT` + messageColumns + messageJoins
+
+// scanMessage scans a row selected with messageColumns. extra destinations are scanned
+// from columns selected after messageColumns. deleted messages are scrubbed to tombstones
+func scanMessage(row pgx.Row, extra ...any) (*MessageResp, error) {
+	var message MessageResp
+	dest := []any{
+		&message.ID,
+		&message.Content,
+		&message.DmID,
+		&message.CreatedAt,
+		&message.IsDeleted,
+		&message.IsEdited,
+		&message.ReplyToID,
+		&message.IsSystem,
+		&message.DeletedAt,
+		&message.ClientNonce,
+		&message.ExpiresAt,
+		&message.ContentAST,
+		&message.PlainText,
+		&message.User.ID,
+		&message.User.Username,
+		&message.User.Avatar,
+		&message.Reactions,
+		&message.Attachments,
+		&message.LinkPreview,
+		&message.ReplyTo,
+		&message.Mentions,
+		&message.ForwardedFrom,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	if message.IsDeleted {
+		message.scrub()
+	}
+	return &message, nil
+}
+
+// MessageFilter selects a page of a dm's history. Before and After are message IDs
+// used as (created_at, id) cursors, Around returns a window centered on a message.
+// with no cursor the latest messages are returned. messages ViewerID deleted for
+// themselves are left out
+type MessageFilter struct {
+	Before   string
+	After    string
+	Around   string
+	PageSize int
+	ViewerID int
+}
+
+type MessagePage struct {
+	Messages []*MessageResp `json:"messages"`
+	// HasMore reports whether there are older messages, or newer ones when paging with After
+	HasMore bool `json:"has_more"`
+	// HasMoreAfter is only set when paging with Around
+	HasMoreAfter bool `json:"has_more_after,omitempty"`
+}
+
+func (m *MessageModel) GetMessages(ctx context.Context, dmID int, filter MessageFilter) (*MessagePage, error) {
+	var (
+		page MessagePage
+		err  error
+	)
+
+	switch {
+	case filter.After != "":
+		page.Messages, page.HasMore, err = m.getMessagesPage(ctx, dmID, filter.ViewerID, filter.After, ">", filter.PageSize)
+	case filter.Around != "":
+		// the target message is part of the older half of the window
+		half := filter.PageSize / 2
+		var older, newer []*MessageResp
+		older, page.HasMore, err = m.getMessagesPage(ctx, dmID, filter.ViewerID, filter.Around, "<=", filter.PageSize-half)
+		if err != nil {
+			return nil, err
+		}
+		newer, page.HasMoreAfter, err = m.getMessagesPage(ctx, dmID, filter.ViewerID, filter.Around, ">", half)
+		page.Messages = append(older, newer...)
+	default:
+		page.Messages, page.HasMore, err = m.getMessagesPage(ctx, dmID, filter.ViewerID, filter.Before, "<", filter.PageSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+// getMessagesPage returns up to limit messages on the op side of the cursor, oldest first.
+// it also reports whether more messages exist past the returned ones
+func (m *MessageModel) getMessagesPage(ctx context.Context, dmID, viewerID int, cursor, op string, limit int) ([]*MessageResp, bool, error) {
+	messages := make([]*MessageResp, 0, limit)
+	if limit <= 0 {
+		return messages, false, nil
+	}
+
+	order := "DESC"
+	if op == ">" {
+		order = "ASC"
+	}
+
+	stmt := messageSelect + `
+		WHERE m.dm_id = $1
+		AND ($2 = '' OR (m.created_at, m.id) ` + op + ` (SELECT created_at, id FROM messages WHERE id = $2))
+		AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = $4)
+		ORDER BY m.created_at ` + order + `, m.id ` + order + `
+		LIMIT $3
+	`
+
+	rows, err := m.Pool.Query(ctx, stmt, dmID, cursor, limit+1, viewerID)
 	if err != nil {
-		return messages, err
+		return nil, false, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var message MessageResp
-		err := rows.Scan(
-			&message.ID,
-			&message.Content,
-			&message.DmID,
-			&message.CreatedAt,
-			&message.IsDeleted,
-			&message.IsEdited,
-			&message.ReplyToID,
-			&message.User.ID,
-			&message.User.Username,
-			&message.User.Avatar,
-			&message.Reactions,
-		)
+		message, err := scanMessage(rows)
 		if err != nil {
-			return messages, err
+			return nil, false, err
 		}
-		messages = append(messages, &message)
+		messages = append(messages, message)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return messages, err
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	if order == "DESC" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	return messages, hasMore, nil
+}
+
+// GetReplies returns every reply to the message, oldest first
+func (m *MessageModel) GetReplies(ctx context.Context, id string) ([]*MessageResp, error) {
+	stmt := messageSelect + `WHERE m.reply_to_id = $1 ORDER BY m.created_at, m.id`
+
+	rows, err := m.Pool.Query(ctx, stmt, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]*MessageResp, 0)
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
 	}
 
 	return messages, nil
@@ -94,49 +346,53 @@ func (m *MessageModel) GetMessage(ctx context.Context, id string, userID int) (*
 		withUserID = 1
 	}
 
-	stmt := `
-	  SELECT 
-			m.id, 
-			m.content, 
-			m.dm_id,
-			m.created_at, 
-			m.is_deleted, 
-			m.is_edited, 
-			m.reply_to_id,
-			u.id AS user_id, 
-			u.username, 
-			u.avatar, 
-			sq2.reactions
-		FROM messages m
-		JOIN users u ON u.id = m.user_id
-		LEFT JOIN (
-			SELECT message_id, json_object_agg(reaction, user_ids) AS reactions FROM 
-				(SELECT r.message_id, r.reaction, json_agg(r.user_id) AS user_ids FROM reactions r
-				  GROUP BY reaction, message_id) sq1 GROUP BY message_id
-		) sq2 ON m.id = message_id
-		WHERE m.id = $1 AND (u.id = $2 OR 1 = $3)`
+	stmt := messageSelect + `WHERE m.id = $1 AND (u.id = $2 OR 1 = $3)`
+	return scanMessage(m.Pool.QueryRow(ctx, stmt, id, userID, withUserID))
+}
 
-	var message MessageResp
-	err := m.Pool.QueryRow(ctx, stmt, id, userID, withUserID).Scan(
-		&message.ID,
-		&message.Content,
-		&message.DmID,
-		&message.CreatedAt,
-		&message.IsDeleted,
-		&message.IsEdited,
-		&message.ReplyToID,
-		&message.User.ID,
-		&message.User.Username,
-		&message.User.Avatar,
-		&message.Reactions,
-	)
+// InsertMessage assigns the message its ID and creation time, inserts it and links its
+// uploaded attachments and reports whether it was inserted. when the sender already sent a
+// message with the same client nonce to the dm nothing is inserted and msg is pointed at the
+// existing message instead
+func (m *MessageModel) InsertMessage(ctx context.Context, msg *Message) (bool, error) {
+	if len(msg.AttachmentIDs) > MaxAttachmentsPerMessage {
+		return false, ErrTooManyAttachments
+	}
+
+	id, err := NewID()
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	msg.ID = id
+	msg.CreatedAt = time.Now().UTC()
+
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if msg.ReplyToID.Valid {
+		var replyDmID int
+		err = tx.QueryRow(ctx, `SELECT dm_id FROM `+liveMessages+` m WHERE id = $1`, msg.ReplyToID).Scan(&replyDmID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return false, err
+		}
+		if err != nil || replyDmID != msg.DmID {
+			return false, ErrInvalidReply
+		}
+	}
+
+	err = checkRequestLimit(ctx, tx, msg.DmID, msg.UserID, msg.ClientNonce)
+	if err != nil {
+		return false, err
+	}
+
+	msg.ExpiresAt, err = messageExpiry(ctx, tx, msg.DmID, msg.CreatedAt)
+	if err != nil {
+		return false, err
 	}
-	return &message, nil
-}
 
-func (m *MessageModel) InsertMessage(ctx context.Context, msg *Message) error {
 	args := []any{
 		msg.ID,
 		msg.Content,
@@ -144,24 +400,186 @@ func (m *MessageModel) InsertMessage(ctx context.Context, msg *Message) error {
 		msg.UserID,
 		msg.CreatedAt,
 		msg.ReplyToID,
+		msg.ClientNonce,
+		msg.ExpiresAt,
+		msg.ContentAST,
+		msg.PlainText,
 	}
-	stmt := `INSERT INTO messages(id, content, dm_id, user_id, created_at, reply_to_id) VALUES ($1, $2, $3, $4, $5, $6)`
-	_, err := m.Pool.Exec(ctx, stmt, args...)
-	return err
+	stmt := `
+		INSERT INTO messages(id, content, dm_id, user_id, created_at, reply_to_id, client_nonce, expires_at, content_ast, plain_text)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (dm_id, user_id, client_nonce) WHERE client_nonce IS NOT NULL DO NOTHING
+		RETURNING id
+	`
+	err = tx.QueryRow(ctx, stmt, args...).Scan(&msg.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		stmt = `SELECT id, created_at, expires_at FROM messages WHERE dm_id = $1 AND user_id = $2 AND client_nonce = $3`
+		err = tx.QueryRow(ctx, stmt, msg.DmID, msg.UserID, msg.ClientNonce).Scan(&msg.ID, &msg.CreatedAt, &msg.ExpiresAt)
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = insertMentions(ctx, tx, msg.ID, msg.Mentions)
+	if err != nil {
+		return false, err
+	}
+
+	if len(msg.AttachmentIDs) > 0 {
+		stmt = `
+			UPDATE attachments SET message_id = $1
+			WHERE id = ANY($2) AND user_id = $3 AND message_id IS NULL
+		`
+		tag, err := tx.Exec(ctx, stmt, msg.ID, msg.AttachmentIDs, msg.UserID)
+		if err != nil {
+			return false, err
+		}
+		if int(tag.RowsAffected()) != len(msg.AttachmentIDs) {
+			return false, ErrInvalidAttachments
+		}
+	}
+
+	return true, tx.Commit(ctx)
 }
 
+// InsertSystemMessage records an event in the dm (e.g. membership changes) as a message authored by userID
+func (m *MessageModel) InsertSystemMessage(ctx context.Context, dmID, userID int, content string) (string, error) {
+	id, err := NewID()
+	if err != nil {
+		return id, err
+	}
+
+	createdAt := time.Now().UTC()
+	expiresAt, err := messageExpiry(ctx, m.Pool, dmID, createdAt)
+	if err != nil {
+		return id, err
+	}
+
+	// system messages aren't parsed, their content is plain text
+	stmt := `
+		INSERT INTO messages(id, content, dm_id, user_id, created_at, is_system, expires_at, content_ast, plain_text)
+		VALUES ($1, $2, $3, $4, $5, TRUE, $6, $7, $2)
+	`
+	_, err = m.Pool.Exec(ctx, stmt, id, content, dmID, userID, createdAt, expiresAt, richtext.Text(content))
+	return id, err
+}
+
+// UpdateMessage updates the message. when the content changes the previous content is
+// kept as a revision in the same transaction. deleted messages can't be updated
 func (m *MessageModel) UpdateMessage(ctx context.Context, id string, msg *MessageResp) error {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var content string
+	var isDeleted bool
+	err = tx.QueryRow(ctx, `SELECT content, is_deleted FROM messages WHERE id = $1 FOR UPDATE`, id).Scan(&content, &isDeleted)
+	if err != nil {
+		return err
+	}
+	if isDeleted {
+		return ErrMessageDeleted
+	}
+
+	if content != msg.Content {
+		stmt := `INSERT INTO message_revisions(message_id, content, edited_at) VALUES ($1, $2, $3)`
+		_, err = tx.Exec(ctx, stmt, id, content, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `DELETE FROM message_mentions WHERE message_id = $1`, id)
+		if err != nil {
+			return err
+		}
+		err = insertMentions(ctx, tx, id, msg.Mentions)
+		if err != nil {
+			return err
+		}
+	}
+
 	args := []any{
 		msg.Content,
-		msg.IsDeleted,
 		msg.IsEdited,
+		msg.ContentAST,
+		msg.PlainText,
 		id,
 	}
 	stmt := `
 	  UPDATE messages
-		SET content = $1, is_deleted = $2, is_edited = $3
-		WHERE id = $4
+		SET content = $1, is_edited = $2, content_ast = $3, plain_text = $4
+		WHERE id = $5
+	`
+	_, err = tx.Exec(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+type MessageRevision struct {
+	ID        int       `json:"id"`
+	MessageID string    `json:"message_id"`
+	Content   string    `json:"content"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+// GetRevisions returns the previous versions of the message, oldest first
+func (m *MessageModel) GetRevisions(ctx context.Context, messageID string) ([]*MessageRevision, error) {
+	stmt := `
+		SELECT id, message_id, content, edited_at FROM message_revisions
+		WHERE message_id = $1
+		ORDER BY edited_at, id
 	`
-	_, err := m.Pool.Exec(ctx, stmt, args...)
+
+	rows, err := m.Pool.Query(ctx, stmt, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]*MessageRevision, 0)
+	for rows.Next() {
+		var r MessageRevision
+		err := rows.Scan(&r.ID, &r.MessageID, &r.Content, &r.EditedAt)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// DeleteRevisionsBefore deletes the revisions replaced before t
+func (m *MessageModel) DeleteRevisionsBefore(ctx context.Context, t time.Time) (int64, error) {
+	tag, err := m.Pool.Exec(ctx, `DELETE FROM message_revisions WHERE edited_at < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+	AuthorName  string `json:"author_name,omitempty"`
+}
+
+func (m *MessageModel) SetLinkPreview(ctx context.Context, id string, p *LinkPreview) error {
+	stmt := `UPDATE messages SET link_preview = $1 WHERE id = $2`
+	_, err := m.Pool.Exec(ctx, stmt, p, id)
 	return err
 }
@@ -3,11 +3,16 @@ package data
 import "github.com/jackc/pgx/v5/pgxpool"
 
 type Models struct {
-	Users     UserModel
-	Messages  MessageModel
-	Tokens    TokenModel
-	DMs       DMModel
-	Reactions ReactionModel
+	Users       UserModel
+	Messages    MessageModel
+	Tokens      TokenModel
+	DMs         DMModel
+	Reactions   ReactionModel
+	Attachments AttachmentModel
+	Pins        PinModel
+	Scheduled   ScheduledMessageModel
+	Emoji       EmojiModel
+	Exports     ExportModel
 }
 
 func NewModels(pool *pgxpool.Pool) *Models {
@@ -27,5 +32,20 @@ func NewModels(pool *pgxpool.Pool) *Models {
 		Reactions: ReactionModel{
 			Pool: pool,
 		},
+		Attachments: AttachmentModel{
+			Pool: pool,
+		},
+		Pins: PinModel{
+			Pool: pool,
+		},
+		Scheduled: ScheduledMessageModel{
+			Pool: pool,
+		},
+		Emoji: EmojiModel{
+			Pool: pool,
+		},
+		Exports: ExportModel{
+			Pool: pool,
+		},
 	}
 }
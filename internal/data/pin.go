@@ -0,0 +1,111 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const MaxPinsPerDM = 50
+
+var ErrTooManyPins = errors.New("the dm has reached the maximum number of pinned messages")
+
+type Pin struct {
+	DmID     int           `json:"dm_id"`
+	PinnedBy BasicUserResp `json:"pinned_by"`
+	PinnedAt time.Time     `json:"pinned_at"`
+	Message  *MessageResp  `json:"message"`
+}
+
+type PinModel struct {
+	Pool *pgxpool.Pool
+}
+
+// Insert pins the message in its dm and reports whether it was pinned. pinning an already
+// pinned message is a no-op and deleted messages can't be pinned
+func (m *PinModel) Insert(ctx context.Context, dmID int, messageID string, userID int) (bool, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// locking the dm serializes concurrent pins so the cap holds
+	_, err = tx.Exec(ctx, `SELECT id FROM dms WHERE id = $1 FOR UPDATE`, dmID)
+	if err != nil {
+		return false, err
+	}
+
+	var isDeleted bool
+	err = tx.QueryRow(ctx, `SELECT is_deleted FROM messages WHERE id = $1 AND dm_id = $2`, messageID, dmID).Scan(&isDeleted)
+	if err != nil {
+		return false, err
+	}
+	if isDeleted {
+		return false, ErrMessageDeleted
+	}
+
+	var count int
+	err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM pinned_messages WHERE dm_id = $1 AND message_id <> $2`, dmID, messageID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count >= MaxPinsPerDM {
+		return false, ErrTooManyPins
+	}
+
+	stmt := `
+		INSERT INTO pinned_messages(message_id, dm_id, pinned_by, pinned_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (message_id) DO NOTHING
+	`
+	tag, err := tx.Exec(ctx, stmt, messageID, dmID, userID, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, tx.Commit(ctx)
+}
+
+// Delete unpins the message from the dm and reports whether it was unpinned
+func (m *PinModel) Delete(ctx context.Context, dmID int, messageID string) (bool, error) {
+	tag, err := m.Pool.Exec(ctx, `DELETE FROM pinned_messages WHERE dm_id = $1 AND message_id = $2`, dmID, messageID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetPins returns the pinned messages of the dm, most recently pinned first
+func (m *PinModel) GetPins(ctx context.Context, dmID int) ([]*Pin, error) {
+	stmt := `SELECT` + messageColumns + `, p.pinned_at, pu.id, pu.username, pu.avatar` + messageJoins + `
+		JOIN pinned_messages p ON p.message_id = m.id
+		JOIN users pu ON pu.id = p.pinned_by
+		WHERE p.dm_id = $1
+		ORDER BY p.pinned_at DESC, m.id
+	`
+
+	rows, err := m.Pool.Query(ctx, stmt, dmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := make([]*Pin, 0)
+	for rows.Next() {
+		pin := Pin{DmID: dmID}
+		pin.Message, err = scanMessage(rows, &pin.PinnedAt, &pin.PinnedBy.ID, &pin.PinnedBy.Username, &pin.PinnedBy.Avatar)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, &pin)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return pins, nil
+}
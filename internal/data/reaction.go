@@ -2,27 +2,132 @@ package data
 
 import (
 	"context"
+	"errors"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// MaxReactionsPerMessage is the number of distinct reactions a message can have
+const MaxReactionsPerMessage = 20
+
+var (
+	ErrInvalidReaction  = errors.New("reaction is not an allowed emoji")
+	ErrTooManyReactions = errors.New("the message has reached the maximum number of distinct reactions")
+)
+
 type Reaction struct {
 	id           int
 	Participants []string
 }
 
+// Reactor is a user who reacted to a message. Cursor identifies their reaction, it's passed
+// back as after to fetch the next page
+type Reactor struct {
+	BasicUserResp
+	Cursor int `json:"cursor"`
+}
+
 type ReactionModel struct {
 	Pool *pgxpool.Pool
 }
 
-func (m *ReactionModel) Insert(ctx context.Context, reaction, msgID string, userID int) error {
-	stmt := `INSERT INTO reactions(reaction, message_id, user_id) VALUES($1, $2, $3)`
-	_, err := m.Pool.Exec(ctx, stmt, reaction, msgID, userID)
-	return err
+// Insert adds the user's reaction to the message and reports whether it was added. the
+// user must be a participant of the message's dm and deleted messages can't be reacted to
+func (m *ReactionModel) Insert(ctx context.Context, reaction, msgID string, userID int) (bool, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// locking the message serializes concurrent reactions so the cap holds
+	var isDeleted, isParticipant bool
+	stmt := `
+		SELECT m.is_deleted, EXISTS (
+			SELECT 1 FROM dm_participants WHERE dm_id = m.dm_id AND participant_id = $2
+		)
+		FROM messages m WHERE m.id = $1
+		FOR UPDATE
+	`
+	err = tx.QueryRow(ctx, stmt, msgID, userID).Scan(&isDeleted, &isParticipant)
+	if err != nil {
+		return false, err
+	}
+	if !isParticipant {
+		return false, ErrNotParticipant
+	}
+	if isDeleted {
+		return false, ErrMessageDeleted
+	}
+
+	var count int
+	stmt = `SELECT COUNT(DISTINCT reaction) FROM reactions WHERE message_id = $1 AND reaction <> $2`
+	err = tx.QueryRow(ctx, stmt, msgID, reaction).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count >= MaxReactionsPerMessage {
+		return false, ErrTooManyReactions
+	}
+
+	stmt = `
+		INSERT INTO reactions(reaction, message_id, user_id) VALUES ($1, $2, $3)
+		ON CONFLICT (message_id, user_id, reaction) DO NOTHING
+	`
+	tag, err := tx.Exec(ctx, stmt, reaction, msgID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, tx.Commit(ctx)
 }
 
-func (m *ReactionModel) Delete(ctx context.Context, reaction, msgID string, userID int) error {
+// Delete removes the user's reaction from the message and reports whether it was removed
+func (m *ReactionModel) Delete(ctx context.Context, reaction, msgID string, userID int) (bool, error) {
 	stmt := `DELETE FROM reactions WHERE reaction = $1 AND message_id = $2 AND user_id = $3`
-	_, err := m.Pool.Exec(ctx, stmt, reaction, msgID, userID)
-	return err
+	tag, err := m.Pool.Exec(ctx, stmt, reaction, msgID, userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetReactors returns the users who reacted to the message with the reaction, in the
+// order they reacted. after is the cursor of the last reactor of the previous page, which
+// stays valid when that user removes their reaction
+func (m *ReactionModel) GetReactors(ctx context.Context, msgID, reaction string, after, limit int) ([]*Reactor, bool, error) {
+	stmt := `
+		SELECT r.id, u.id, u.username, u.avatar FROM reactions r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.message_id = $1 AND r.reaction = $2 AND r.id > $3
+		ORDER BY r.id
+		LIMIT $4
+	`
+	rows, err := m.Pool.Query(ctx, stmt, msgID, reaction, after, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	users := make([]*Reactor, 0, limit)
+	for rows.Next() {
+		var u Reactor
+		err := rows.Scan(&u.Cursor, &u.ID, &u.Username, &u.Avatar)
+		if err != nil {
+			return nil, false, err
+		}
+		users = append(users, &u)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(users) > limit
+	if hasMore {
+		users = users[:limit]
+	}
+
+	return users, hasMore, nil
 }
@@ -0,0 +1,222 @@
+package data
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"gopkg.in/guregu/null.v4"
+)
+
+// DMPolicy is who can send a user message requests. friends can always message each other
+type DMPolicy string
+
+const (
+	DMPolicyEveryone  DMPolicy = "everyone"
+	DMPolicyFollowing DMPolicy = "following"
+	DMPolicyFriends   DMPolicy = "friends"
+)
+
+func (p DMPolicy) Valid() bool {
+	return p == DMPolicyEveryone || p == DMPolicyFollowing || p == DMPolicyFriends
+}
+
+const (
+	RequestPending  = "pending"
+	RequestAccepted = "accepted"
+	RequestDeclined = "declined"
+)
+
+// MaxRequestMessages is the number of messages a requester can send before the request is accepted
+const MaxRequestMessages = 3
+
+var (
+	ErrInvalidDMPolicy   = errors.New("dm_policy must be one of everyone, following and friends")
+	ErrRequestNotAllowed = errors.New("the user doesn't accept message requests from you")
+	ErrRequestDeclined   = errors.New("the user declined your message request")
+	ErrNotPendingRequest = errors.New("the dm is not a pending message request to you")
+	ErrRequestLimit      = errors.New("the message request has reached the maximum number of messages until it is accepted")
+)
+
+func (m *UserModel) SetDMPolicy(ctx context.Context, userID int, policy DMPolicy) error {
+	if !policy.Valid() {
+		return ErrInvalidDMPolicy
+	}
+	_, err := m.Pool.Exec(ctx, `UPDATE users SET dm_policy = $1 WHERE id = $2`, policy, userID)
+	return err
+}
+
+// CanRequest reports whether the requester can send the recipient message requests under
+// the recipient's dm policy. users blocking each other can't
+func (m *UserModel) CanRequest(ctx context.Context, requesterID, recipientID int) (bool, error) {
+	stmt := `
+		SELECT NOT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+		) AND (
+			u.dm_policy = 'everyone'
+			OR (u.dm_policy = 'following' AND EXISTS (
+				SELECT 1 FROM follow_relations WHERE follower_id = $2 AND following_id = $1
+			))
+		)
+		FROM users u WHERE u.id = $2
+	`
+	var ok bool
+	err := m.Pool.QueryRow(ctx, stmt, requesterID, recipientID).Scan(&ok)
+	return ok, err
+}
+
+// IsBlocked reports whether either user blocks the other
+func (m *UserModel) IsBlocked(ctx context.Context, userID, otherID int) (bool, error) {
+	stmt := `
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+		)
+	`
+	var blocked bool
+	err := m.Pool.QueryRow(ctx, stmt, userID, otherID).Scan(&blocked)
+	return blocked, err
+}
+
+// Block blocks the user, blocking a user who doesn't exist returns pgx.ErrNoRows
+func (m *UserModel) Block(ctx context.Context, blockerID, blockedID int) error {
+	stmt := `
+		INSERT INTO user_blocks(blocker_id, blocked_id) SELECT $1, id FROM users WHERE id = $2
+		ON CONFLICT DO NOTHING
+		RETURNING blocked_id
+	`
+	var id int
+	err := m.Pool.QueryRow(ctx, stmt, blockerID, blockedID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// nothing was inserted either because the user doesn't exist or is already blocked
+		var exists bool
+		err = m.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, blockedID).Scan(&exists)
+		if err == nil && !exists {
+			err = pgx.ErrNoRows
+		}
+	}
+	return err
+}
+
+// Unblock unblocks the user. a request between them that was declined is cleared, so the
+// unblocked user can send a new one
+func (m *UserModel) Unblock(ctx context.Context, blockerID, blockedID int) error {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2`, blockerID, blockedID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, clearRequestStmt+` AND d.request_status = 'declined'`, blockerID, blockedID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// clearRequestStmt turns the one to one dm between $1 and $2 back into a plain dm
+const clearRequestStmt = `
+	UPDATE dms d SET request_status = NULL, requested_by = NULL
+	WHERE NOT d.is_group
+	AND EXISTS (SELECT 1 FROM dm_participants WHERE dm_id = d.id AND participant_id = $1)
+	AND EXISTS (SELECT 1 FROM dm_participants WHERE dm_id = d.id AND participant_id = $2)
+`
+
+// ClearRequest clears a pending or declined request between the users once they are
+// friends, so their dm is a plain dm again. accepted requests are kept, they still allow
+// posting if the users stop being friends
+func (m *DMModel) ClearRequest(ctx context.Context, userID, otherID int) error {
+	_, err := m.Pool.Exec(ctx, clearRequestStmt+` AND d.request_status IN ('pending', 'declined')`, userID, otherID)
+	return err
+}
+
+// CreateRequest returns the one to one dm between the users and its request status, turning
+// it into a message request from requesterID when it isn't one yet
+func (m *DMModel) CreateRequest(ctx context.Context, requesterID, recipientID int) (int, string, error) {
+	dmID, err := m.GetDMForParticipants(ctx, []int{requesterID, recipientID})
+	if err != nil {
+		return dmID, "", err
+	}
+
+	stmt := `
+		UPDATE dms SET request_status = 'pending', requested_by = $2
+		WHERE id = $1 AND request_status IS NULL
+	`
+	_, err = m.Pool.Exec(ctx, stmt, dmID, requesterID)
+	if err != nil {
+		return dmID, "", err
+	}
+
+	var status null.String
+	err = m.Pool.QueryRow(ctx, `SELECT request_status FROM dms WHERE id = $1`, dmID).Scan(&status)
+	if err != nil {
+		return dmID, "", err
+	}
+	if status.String == RequestDeclined {
+		return dmID, status.String, ErrRequestDeclined
+	}
+
+	return dmID, status.String, nil
+}
+
+// RespondToRequest accepts or declines the pending request to recipientID
+func (m *DMModel) RespondToRequest(ctx context.Context, dmID, recipientID int, status string) error {
+	stmt := `
+		UPDATE dms SET request_status = $1
+		WHERE id = $2 AND request_status = 'pending' AND requested_by <> $3
+	`
+	tag, err := m.Pool.Exec(ctx, stmt, status, dmID, recipientID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotPendingRequest
+	}
+	return nil
+}
+
+// CountMessagesBy counts the messages the user sent to the dm
+func (m *DMModel) CountMessagesBy(ctx context.Context, dmID, userID int) (int, error) {
+	var count int
+	stmt := `SELECT COUNT(*) FROM messages WHERE dm_id = $1 AND user_id = $2 AND NOT is_system`
+	err := m.Pool.QueryRow(ctx, stmt, dmID, userID).Scan(&count)
+	return count, err
+}
+
+// checkRequestLimit enforces MaxRequestMessages within the transaction inserting a message.
+// the dm is locked when it's a pending request by the user, so concurrent sends can't
+// both pass the count. a retry of a message already sent with the nonce is let through
+// to be deduplicated
+func checkRequestLimit(ctx context.Context, tx pgx.Tx, dmID, userID int, nonce null.String) error {
+	var id int
+	stmt := `SELECT id FROM dms WHERE id = $1 AND request_status = 'pending' AND requested_by = $2 FOR UPDATE`
+	err := tx.QueryRow(ctx, stmt, dmID, userID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var count int
+	var sent bool
+	stmt = `
+		SELECT COUNT(*), COALESCE(bool_or(client_nonce = $3), false) FROM messages
+		WHERE dm_id = $1 AND user_id = $2 AND NOT is_system
+	`
+	err = tx.QueryRow(ctx, stmt, dmID, userID, nonce).Scan(&count, &sent)
+	if err != nil {
+		return err
+	}
+	if count >= MaxRequestMessages && !sent {
+		return ErrRequestLimit
+	}
+	return nil
+}
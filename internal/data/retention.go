@@ -0,0 +1,158 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gopkg.in/guregu/null.v4"
+)
+
+// Retention is how long the messages of a dm are kept before they disappear
+type Retention string
+
+const (
+	RetentionOff     Retention = "off"
+	Retention24Hours Retention = "24h"
+	Retention7Days   Retention = "7d"
+	Retention90Days  Retention = "90d"
+)
+
+var retentionDurations = map[Retention]time.Duration{
+	Retention24Hours: 24 * time.Hour,
+	Retention7Days:   7 * 24 * time.Hour,
+	Retention90Days:  90 * 24 * time.Hour,
+}
+
+var ErrInvalidRetention = errors.New("retention must be one of off, 24h, 7d and 90d")
+
+func (r Retention) Valid() bool {
+	_, ok := retentionDurations[r]
+	return ok || r == RetentionOff
+}
+
+// liveMessages are the messages that haven't expired yet. expired messages are left out
+// even before the sweeper deletes them
+const liveMessages = `(SELECT * FROM messages WHERE expires_at IS NULL OR expires_at > NOW())`
+
+// queryRower is implemented by both the pool and transactions
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// messageExpiry returns when a message created at createdAt in the dm expires under the
+// dm's current retention. changing the retention only affects messages sent afterwards
+func messageExpiry(ctx context.Context, q queryRower, dmID int, createdAt time.Time) (null.Time, error) {
+	var retention Retention
+	err := q.QueryRow(ctx, `SELECT retention FROM dms WHERE id = $1`, dmID).Scan(&retention)
+	if err != nil {
+		return null.Time{}, err
+	}
+
+	d, ok := retentionDurations[retention]
+	if !ok {
+		return null.Time{}, nil
+	}
+	return null.TimeFrom(createdAt.Add(d)), nil
+}
+
+// SetRetention changes the retention of the dm
+func (m *DMModel) SetRetention(ctx context.Context, dmID int, retention Retention) error {
+	if !retention.Valid() {
+		return ErrInvalidRetention
+	}
+	_, err := m.Pool.Exec(ctx, `UPDATE dms SET retention = $1 WHERE id = $2`, retention, dmID)
+	return err
+}
+
+type ExpiredMessage struct {
+	ID   string
+	DmID int
+}
+
+// DeleteExpired hard deletes up to limit expired messages with their reactions, revisions,
+// pins and attachments. it returns the deleted messages and the blob keys of their
+// attachments, which the caller should remove from storage
+func (m *MessageModel) DeleteExpired(ctx context.Context, limit int) ([]ExpiredMessage, []string, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	stmt := `
+		SELECT id FROM messages
+		WHERE expires_at <= NOW()
+		ORDER BY expires_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`
+	rows, err := tx.Query(ctx, stmt, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, 0, limit)
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+
+	keys, err := deleteMessageData(ctx, tx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, stmt := range []string{
+		`DELETE FROM hidden_messages WHERE message_id = ANY($1)`,
+		// read markers on a deleted message move back to the newest message before it
+		`UPDATE dm_participants dp SET last_read_message_id = (
+			SELECT pm.id FROM messages pm, messages cur
+			WHERE cur.id = dp.last_read_message_id AND pm.dm_id = dp.dm_id
+			AND pm.id <> ALL($1) AND (pm.created_at, pm.id) < (cur.created_at, cur.id)
+			ORDER BY pm.created_at DESC, pm.id DESC
+			LIMIT 1
+		)
+		WHERE dp.last_read_message_id = ANY($1)`,
+	} {
+		_, err = tx.Exec(ctx, stmt, ids)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rows, err = tx.Query(ctx, `DELETE FROM messages WHERE id = ANY($1) RETURNING id, dm_id`, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	expired := make([]ExpiredMessage, 0, len(ids))
+	for rows.Next() {
+		var e ExpiredMessage
+		err = rows.Scan(&e.ID, &e.DmID)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return expired, keys, tx.Commit(ctx)
+}
@@ -0,0 +1,238 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gopkg.in/guregu/null.v4"
+)
+
+var ErrSendAtInPast = errors.New("send_at must be in the future")
+
+// ScheduledMessage is a message waiting to be sent to its dm at SendAt
+type ScheduledMessage struct {
+	ID            string      `json:"id"`
+	DmID          int         `json:"dm_id"`
+	UserID        int         `json:"user_id"`
+	Content       string      `json:"content"`
+	ReplyToID     null.String `json:"reply_to_id"`
+	AttachmentIDs []string    `json:"attachment_ids"`
+	SendAt        time.Time   `json:"send_at"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// Message returns the message to insert when the scheduled message is sent. the nonce is
+// derived from the scheduled message so sending it twice only inserts it once
+func (s *ScheduledMessage) Message() *Message {
+	return &Message{
+		Content:       s.Content,
+		DmID:          s.DmID,
+		UserID:        s.UserID,
+		ReplyToID:     s.ReplyToID,
+		AttachmentIDs: s.AttachmentIDs,
+		ClientNonce:   null.StringFrom("scheduled:" + s.ID),
+	}
+}
+
+type ScheduledMessageModel struct {
+	Pool *pgxpool.Pool
+}
+
+const scheduledMessageColumns = `id, dm_id, user_id, content, reply_to_id, attachment_ids, send_at, created_at`
+
+func scanScheduledMessage(row pgx.Row) (*ScheduledMessage, error) {
+	var s ScheduledMessage
+	err := row.Scan(
+		&s.ID,
+		&s.DmID,
+		&s.UserID,
+		&s.Content,
+		&s.ReplyToID,
+		&s.AttachmentIDs,
+		&s.SendAt,
+		&s.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (m *ScheduledMessageModel) Insert(ctx context.Context, s *ScheduledMessage) error {
+	if !s.SendAt.After(time.Now()) {
+		return ErrSendAtInPast
+	}
+	if len(s.AttachmentIDs) > MaxAttachmentsPerMessage {
+		return ErrTooManyAttachments
+	}
+	if strings.TrimSpace(s.Content) == "" && len(s.AttachmentIDs) == 0 {
+		return ErrEmptyMessage
+	}
+	_, err := parseContent(s.Content)
+	if err != nil {
+		return err
+	}
+	if s.AttachmentIDs == nil {
+		s.AttachmentIDs = []string{}
+	}
+
+	s.ID, err = NewID()
+	if err != nil {
+		return err
+	}
+	s.CreatedAt = time.Now().UTC()
+	s.SendAt = s.SendAt.UTC()
+
+	stmt := `
+		INSERT INTO scheduled_messages(` + scheduledMessageColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err = m.Pool.Exec(ctx, stmt, s.ID, s.DmID, s.UserID, s.Content, s.ReplyToID, s.AttachmentIDs, s.SendAt, s.CreatedAt)
+	return err
+}
+
+// Get returns the user's scheduled message
+func (m *ScheduledMessageModel) Get(ctx context.Context, id string, userID int) (*ScheduledMessage, error) {
+	stmt := `SELECT ` + scheduledMessageColumns + ` FROM scheduled_messages WHERE id = $1 AND user_id = $2`
+	return scanScheduledMessage(m.Pool.QueryRow(ctx, stmt, id, userID))
+}
+
+// GetForUser returns the user's pending messages, the ones due first first.
+// a dmID of 0 returns the pending messages of every dm
+func (m *ScheduledMessageModel) GetForUser(ctx context.Context, userID, dmID int) ([]*ScheduledMessage, error) {
+	stmt := `
+		SELECT ` + scheduledMessageColumns + ` FROM scheduled_messages
+		WHERE user_id = $1 AND ($2 = 0 OR dm_id = $2)
+		ORDER BY send_at, id
+	`
+	rows, err := m.Pool.Query(ctx, stmt, userID, dmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scheduled := make([]*ScheduledMessage, 0)
+	for rows.Next() {
+		s, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, s)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return scheduled, nil
+}
+
+// Update saves the content and send time of the scheduled message. a message that is
+// being sent is locked by the dispatcher, so updating it waits and then finds no row. the
+// content can only be emptied when the message has attachments
+func (m *ScheduledMessageModel) Update(ctx context.Context, s *ScheduledMessage) error {
+	if !s.SendAt.After(time.Now()) {
+		return ErrSendAtInPast
+	}
+	_, err := parseContent(s.Content)
+	if err != nil {
+		return err
+	}
+	s.SendAt = s.SendAt.UTC()
+
+	empty := strings.TrimSpace(s.Content) == ""
+	stmt := `
+		UPDATE scheduled_messages SET content = $1, send_at = $2
+		WHERE id = $3 AND user_id = $4 AND (NOT $5 OR cardinality(attachment_ids) > 0)
+	`
+	tag, err := m.Pool.Exec(ctx, stmt, s.Content, s.SendAt, s.ID, s.UserID, empty)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+	if !empty {
+		return pgx.ErrNoRows
+	}
+
+	var exists bool
+	stmt = `SELECT EXISTS (SELECT 1 FROM scheduled_messages WHERE id = $1 AND user_id = $2)`
+	err = m.Pool.QueryRow(ctx, stmt, s.ID, s.UserID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrEmptyMessage
+	}
+	return pgx.ErrNoRows
+}
+
+// Delete cancels the user's scheduled message
+func (m *ScheduledMessageModel) Delete(ctx context.Context, id string, userID int) error {
+	tag, err := m.Pool.Exec(ctx, `DELETE FROM scheduled_messages WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Dispatch calls send with up to limit due messages and deletes the ones it returns no
+// error for. the rows stay locked until they are deleted and rows locked by another
+// dispatcher are skipped, so concurrent dispatchers never send the same message
+func (m *ScheduledMessageModel) Dispatch(ctx context.Context, limit int, send func(*ScheduledMessage) error) (int, error) {
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	stmt := `
+		SELECT ` + scheduledMessageColumns + ` FROM scheduled_messages
+		WHERE send_at <= $1
+		ORDER BY send_at, id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`
+	rows, err := tx.Query(ctx, stmt, time.Now().UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	due := make([]*ScheduledMessage, 0)
+	for rows.Next() {
+		s, err := scanScheduledMessage(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := make([]string, 0, len(due))
+	for _, s := range due {
+		if send(s) == nil {
+			sent = append(sent, s.ID)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM scheduled_messages WHERE id = ANY($1)`, sent)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(sent), tx.Commit(ctx)
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"context"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// SearchFilter narrows a message search. Before is the ID of the last result of the previous page
+type SearchFilter struct {
+	Query    string
+	DmID     int
+	SenderID int
+	From     null.Time
+	To       null.Time
+	Before   string
+	PageSize int
+}
+
+type MessageSearchResult struct {
+	*MessageResp
+	// Snippet is html escaped content with the matches wrapped in <mark> tags
+	Snippet string `json:"snippet"`
+}
+
+// SearchMessages searches the messages of the dms userID participates in, newest first
+func (m *MessageModel) SearchMessages(ctx context.Context, userID int, filter SearchFilter) ([]*MessageSearchResult, bool, error) {
+	stmt := `
+		WITH matches AS (
+			SELECT m.id FROM ` + liveMessages + ` m
+			JOIN dm_participants dp ON dp.dm_id = m.dm_id AND dp.participant_id = $1
+			WHERE m.search_vector @@ websearch_to_tsquery('simple', $2)
+			AND NOT m.is_deleted AND NOT m.is_system
+			AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = $1)
+			AND ($3 = 0 OR m.dm_id = $3)
+			AND ($4 = 0 OR m.user_id = $4)
+			AND ($5::timestamptz IS NULL OR m.created_at >= $5)
+			AND ($6::timestamptz IS NULL OR m.created_at < $6)
+			AND ($7 = '' OR (m.created_at, m.id) < (SELECT created_at, id FROM messages WHERE id = $7))
+			ORDER BY m.created_at DESC, m.id DESC
+			LIMIT $8
+		)
+		SELECT` + messageColumns + `,
+		ts_headline(
+			'simple',
+			replace(replace(replace(COALESCE(m.plain_text, m.content), '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+			websearch_to_tsquery('simple', $2),
+			'StartSel=<mark>, StopSel=</mark>, MaxWords=24, MinWords=8, MaxFragments=2'
+		)` + messageJoins + `
+		JOIN matches mt ON mt.id = m.id
+		ORDER BY m.created_at DESC, m.id DESC
+	`
+
+	args := []any{
+		userID,
+		filter.Query,
+		filter.DmID,
+		filter.SenderID,
+		filter.From,
+		filter.To,
+		filter.Before,
+		filter.PageSize + 1,
+	}
+
+	rows, err := m.Pool.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	results := make([]*MessageSearchResult, 0)
+	for rows.Next() {
+		var result MessageSearchResult
+		result.MessageResp, err = scanMessage(rows, &result.Snippet)
+		if err != nil {
+			return nil, false, err
+		}
+		results = append(results, &result)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(results) > filter.PageSize
+	if hasMore {
+		results = results[:filter.PageSize]
+	}
+
+	return results, hasMore, nil
+}
@@ -17,6 +17,8 @@ type User struct {
 	Username string `json:"username"`
 	Avatar   string `json:"avatar"`
 	Bio      string `json:"bio"`
+	// DMPolicy is who can send the user message requests
+	DMPolicy DMPolicy `json:"dm_policy"`
 }
 
 type SearchUserResp struct {
@@ -72,11 +74,11 @@ func (m *UserModel) AddUser(ctx context.Context, u *User) (int, error) {
 func (m *UserModel) GetUserForToken(ctx context.Context, token, scope string) (*User, error) {
 	hash := sha256.Sum256([]byte(token))
 
-	stmt := `SELECT id, username, avatar, bio FROM users u 
+	stmt := `SELECT id, username, avatar, bio, dm_policy FROM users u 
 	 LEFT JOIN tokens t ON t.user_id = u.id WHERE t.hash = $1 AND scope = $2 AND t.expiry_time >= CURRENT_TIMESTAMP`
 
 	var u User
-	err := m.Pool.QueryRow(ctx, stmt, hash[:], scope).Scan(&u.ID, &u.Username, &u.Avatar, &u.Bio)
+	err := m.Pool.QueryRow(ctx, stmt, hash[:], scope).Scan(&u.ID, &u.Username, &u.Avatar, &u.Bio, &u.DMPolicy)
 	if err != nil {
 		return nil, err
 	}
@@ -145,20 +147,38 @@ func (m *UserModel) GetUsers(ctx context.Context, userID int, username string) (
 	return users, nil
 }
 
-func (m *UserModel) FollowUser(ctx context.Context, followingID, followerID int) error {
+// FollowUser reports whether the follow was added, following a user again is a no-op
+func (m *UserModel) FollowUser(ctx context.Context, followingID, followerID int) (bool, error) {
 	stmt := `
 	 INSERT INTO follow_relations(following_id, follower_id) VALUES($1, $2)
+	 ON CONFLICT DO NOTHING
 	`
-	_, err := m.Pool.Exec(ctx, stmt, followingID, followerID)
-	return err
+	tag, err := m.Pool.Exec(ctx, stmt, followingID, followerID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
 }
 
-func (m *UserModel) UnfollowUser(ctx context.Context, followingID, followerID int) error {
+// UnfollowUser reports whether the follow was removed and whether the users were friends
+// before it. the follow back is read and locked by the same statement that removes the follow
+func (m *UserModel) UnfollowUser(ctx context.Context, followingID, followerID int) (bool, bool, error) {
 	stmt := `
-	 DELETE FROM follow_relations WHERE following_id = $1 AND follower_id = $2
+	 WITH followed_back AS (
+	   SELECT 1 FROM follow_relations WHERE following_id = $2 AND follower_id = $1
+	   FOR SHARE
+	 ), deleted AS (
+	   DELETE FROM follow_relations WHERE following_id = $1 AND follower_id = $2
+	   RETURNING 1
+	 )
+	 SELECT EXISTS(SELECT 1 FROM deleted), EXISTS(SELECT 1 FROM deleted) AND EXISTS(SELECT 1 FROM followed_back)
 	`
-	_, err := m.Pool.Exec(ctx, stmt, followingID, followerID)
-	return err
+	var unfollowed, wasFriends bool
+	err := m.Pool.QueryRow(ctx, stmt, followingID, followerID).Scan(&unfollowed, &wasFriends)
+	if err != nil {
+		return false, false, err
+	}
+	return unfollowed, wasFriends, nil
 }
 
 func (m *UserModel) GetUsersForRelation(ctx context.Context, relation Relation, userID int) ([]*BasicUserResp, error) {
@@ -0,0 +1,118 @@
+package policy
+
+import (
+	"context"
+
+	"github.com/kickbu2towski/brb-api/internal/data"
+)
+
+// Users is what the policy needs to know about the relationship between users,
+// implemented by data.UserModel
+type Users interface {
+	IsFriends(ctx context.Context, participants []int) (bool, error)
+	IsBlocked(ctx context.Context, userID, otherID int) (bool, error)
+	CanRequest(ctx context.Context, requesterID, recipientID int) (bool, error)
+}
+
+// DMs is what the policy needs to know about dms beyond the dm itself, implemented by
+// data.DMModel
+type DMs interface {
+	CountMessagesBy(ctx context.Context, dmID, userID int) (int, error)
+}
+
+// Policy decides what users can do in dms. every REST and websocket path checks access
+// through it rather than on its own
+type Policy struct {
+	users Users
+	dms   DMs
+}
+
+func New(users Users, dms DMs) *Policy {
+	return &Policy{users: users, dms: dms}
+}
+
+// CanReadDM reports whether the user can read the dm's messages and the things attached to
+// them. any participant can, including the recipient of a pending or declined request
+func (p *Policy) CanReadDM(dm *data.DM, userID int) bool {
+	return dm.HasParticipant(userID)
+}
+
+// CanReadMessage reports whether the user can read the message of the dm
+func (p *Policy) CanReadMessage(dm *data.DM, m *data.MessageResp, userID int) bool {
+	return m.DmID == dm.ID && p.CanReadDM(dm, userID)
+}
+
+// CanPostToDM reports whether the user can send messages to the dm. one to one dms are
+// only allowed between friends or after a message request was accepted, while a pending
+// request lets the requester send a few messages. a declined request no longer matters
+// once the users are friends
+func (p *Policy) CanPostToDM(ctx context.Context, dm *data.DM, userID int) (bool, error) {
+	if !dm.HasParticipant(userID) {
+		return false, nil
+	}
+	if dm.IsGroup {
+		return true, nil
+	}
+
+	var others []int
+	for _, id := range dm.ParticipantIDs() {
+		if id != userID {
+			others = append(others, id)
+		}
+	}
+	if len(others) != 1 {
+		return false, nil
+	}
+
+	switch dm.RequestStatus.String {
+	case data.RequestPending:
+		if int(dm.RequestedBy.Int64) != userID {
+			return false, nil
+		}
+		canRequest, err := p.users.CanRequest(ctx, userID, others[0])
+		if err != nil || !canRequest {
+			return false, err
+		}
+		count, err := p.dms.CountMessagesBy(ctx, dm.ID, userID)
+		if err != nil {
+			return false, err
+		}
+		return count < data.MaxRequestMessages, nil
+	}
+
+	blocked, err := p.users.IsBlocked(ctx, userID, others[0])
+	if err != nil || blocked {
+		return false, err
+	}
+	if dm.RequestStatus.String == data.RequestAccepted {
+		return true, nil
+	}
+	return p.users.IsFriends(ctx, dm.ParticipantIDs())
+}
+
+// CanModifyMessage reports whether the user can edit the message or delete it for everyone.
+// only the author can, while they can still post to the dm. system messages can't be modified
+func (p *Policy) CanModifyMessage(ctx context.Context, dm *data.DM, m *data.MessageResp, userID int) (bool, error) {
+	if m.DmID != dm.ID || m.IsSystem || m.User.ID != userID {
+		return false, nil
+	}
+	return p.CanPostToDM(ctx, dm, userID)
+}
+
+// CanReactToMessage reports whether the user can react to the message or pin it, which any
+// participant who can post to the dm can
+func (p *Policy) CanReactToMessage(ctx context.Context, dm *data.DM, m *data.MessageResp, userID int) (bool, error) {
+	if m.DmID != dm.ID {
+		return false, nil
+	}
+	return p.CanPostToDM(ctx, dm, userID)
+}
+
+// CanRemoveMember reports whether the user can remove the member from the group. the owner
+// can remove anyone, other participants can only leave
+func (p *Policy) CanRemoveMember(dm *data.DM, userID, memberID int) bool {
+	if !dm.IsGroup || !dm.HasParticipant(userID) {
+		return false
+	}
+	return int(dm.OwnerID.Int64) == userID || memberID == userID
+}
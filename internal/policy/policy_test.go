@@ -0,0 +1,279 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kickbu2towski/brb-api/internal/data"
+	"gopkg.in/guregu/null.v4"
+)
+
+const (
+	alice = iota + 1
+	bob
+	carol
+	mallory
+)
+
+// fakeStore answers the policy's questions about the relationship between the two users
+// of a one to one dm
+type fakeStore struct {
+	friends    bool
+	blocked    bool
+	canRequest bool
+	sent       int
+	err        error
+}
+
+func (s fakeStore) IsFriends(ctx context.Context, participants []int) (bool, error) {
+	return s.friends, s.err
+}
+
+func (s fakeStore) IsBlocked(ctx context.Context, userID, otherID int) (bool, error) {
+	return s.blocked, s.err
+}
+
+func (s fakeStore) CanRequest(ctx context.Context, requesterID, recipientID int) (bool, error) {
+	return s.canRequest, s.err
+}
+
+func (s fakeStore) CountMessagesBy(ctx context.Context, dmID, userID int) (int, error) {
+	return s.sent, s.err
+}
+
+func newDM(id int, userIDs ...int) *data.DM {
+	dm := &data.DM{ID: id}
+	for _, userID := range userIDs {
+		dm.Participants = append(dm.Participants, &data.BasicUserResp{ID: userID})
+	}
+	return dm
+}
+
+func directDM() *data.DM {
+	return newDM(1, alice, bob)
+}
+
+func requestDM(status string) *data.DM {
+	dm := newDM(1, alice, bob)
+	dm.RequestStatus = null.StringFrom(status)
+	dm.RequestedBy = null.IntFrom(alice)
+	return dm
+}
+
+func groupDM() *data.DM {
+	dm := newDM(2, alice, bob, carol)
+	dm.IsGroup = true
+	dm.OwnerID = null.IntFrom(alice)
+	return dm
+}
+
+func newMessage(dmID, authorID int) *data.MessageResp {
+	return &data.MessageResp{
+		Message: data.Message{ID: "m", DmID: dmID},
+		User:    data.BasicUserResp{ID: authorID},
+	}
+}
+
+func systemMessage(dmID, authorID int) *data.MessageResp {
+	m := newMessage(dmID, authorID)
+	m.IsSystem = true
+	return m
+}
+
+// action is a check of the policy against a dm, the message of the case and a user
+type action func(p *Policy, dm *data.DM, m *data.MessageResp, userID int) (bool, error)
+
+var actions = map[string]action{
+	"read dm": func(p *Policy, dm *data.DM, m *data.MessageResp, userID int) (bool, error) {
+		return p.CanReadDM(dm, userID), nil
+	},
+	"read message": func(p *Policy, dm *data.DM, m *data.MessageResp, userID int) (bool, error) {
+		return p.CanReadMessage(dm, m, userID), nil
+	},
+	"post": func(p *Policy, dm *data.DM, m *data.MessageResp, userID int) (bool, error) {
+		return p.CanPostToDM(context.Background(), dm, userID)
+	},
+	"modify message": func(p *Policy, dm *data.DM, m *data.MessageResp, userID int) (bool, error) {
+		return p.CanModifyMessage(context.Background(), dm, m, userID)
+	},
+	"react": func(p *Policy, dm *data.DM, m *data.MessageResp, userID int) (bool, error) {
+		return p.CanReactToMessage(context.Background(), dm, m, userID)
+	},
+	"remove self": func(p *Policy, dm *data.DM, m *data.MessageResp, userID int) (bool, error) {
+		return p.CanRemoveMember(dm, userID, userID), nil
+	},
+}
+
+func TestPolicy(t *testing.T) {
+	friends := fakeStore{friends: true}
+	strangers := fakeStore{canRequest: true}
+
+	tests := []struct {
+		name   string
+		action string
+		store  fakeStore
+		dm     *data.DM
+		msg    *data.MessageResp
+		userID int
+		want   bool
+	}{
+		// reading
+		{"participant reads dm", "read dm", friends, directDM(), nil, alice, true},
+		{"non participant reads dm", "read dm", friends, directDM(), nil, mallory, false},
+		{"recipient reads pending request", "read dm", strangers, requestDM(data.RequestPending), nil, bob, true},
+		{"recipient reads declined request", "read dm", strangers, requestDM(data.RequestDeclined), nil, bob, true},
+		{"group member reads group", "read dm", friends, groupDM(), nil, carol, true},
+		{"non member reads group", "read dm", friends, groupDM(), nil, mallory, false},
+		{"participant reads message", "read message", friends, directDM(), newMessage(1, bob), alice, true},
+		{"non participant reads message", "read message", friends, directDM(), newMessage(1, bob), mallory, false},
+		{"participant reads message of another dm", "read message", friends, directDM(), newMessage(3, bob), alice, false},
+		{"group member reads message", "read message", friends, groupDM(), newMessage(2, alice), carol, true},
+
+		// posting
+		{"friend posts", "post", friends, directDM(), nil, alice, true},
+		{"non participant posts", "post", friends, directDM(), nil, mallory, false},
+		{"non friend posts", "post", strangers, directDM(), nil, alice, false},
+		{"blocked friend posts", "post", fakeStore{friends: true, blocked: true}, directDM(), nil, alice, false},
+		{"requester posts to pending request", "post", strangers, requestDM(data.RequestPending), nil, alice, true},
+		{"requester posts over request limit", "post", fakeStore{canRequest: true, sent: data.MaxRequestMessages}, requestDM(data.RequestPending), nil, alice, false},
+		{"requester no longer allowed to request posts", "post", fakeStore{}, requestDM(data.RequestPending), nil, alice, false},
+		{"recipient posts to pending request", "post", strangers, requestDM(data.RequestPending), nil, bob, false},
+		{"requester posts to declined request", "post", strangers, requestDM(data.RequestDeclined), nil, alice, false},
+		{"requester posts to declined request after becoming friends", "post", friends, requestDM(data.RequestDeclined), nil, alice, true},
+		{"recipient posts to declined request after becoming friends", "post", friends, requestDM(data.RequestDeclined), nil, bob, true},
+		{"blocked friend posts to declined request", "post", fakeStore{friends: true, blocked: true}, requestDM(data.RequestDeclined), nil, alice, false},
+		{"non friend posts to accepted request", "post", fakeStore{}, requestDM(data.RequestAccepted), nil, bob, true},
+		{"blocked user posts to accepted request", "post", fakeStore{blocked: true}, requestDM(data.RequestAccepted), nil, bob, false},
+		{"non participant posts to pending request", "post", strangers, requestDM(data.RequestPending), nil, mallory, false},
+		{"group member posts", "post", fakeStore{}, groupDM(), nil, carol, true},
+		{"non member posts to group", "post", friends, groupDM(), nil, mallory, false},
+		{"participant posts to dm with themselves", "post", friends, newDM(1, alice), nil, alice, false},
+
+		// modifying messages
+		{"author modifies message", "modify message", friends, directDM(), newMessage(1, alice), alice, true},
+		{"participant modifies other's message", "modify message", friends, directDM(), newMessage(1, bob), alice, false},
+		{"non participant modifies message", "modify message", friends, directDM(), newMessage(1, bob), mallory, false},
+		{"author no longer friends modifies message", "modify message", strangers, directDM(), newMessage(1, alice), alice, false},
+		{"author modifies message of another dm", "modify message", friends, directDM(), newMessage(3, alice), alice, false},
+		{"author modifies system message", "modify message", friends, groupDM(), systemMessage(2, alice), alice, false},
+		{"group member modifies own message", "modify message", fakeStore{}, groupDM(), newMessage(2, carol), carol, true},
+		{"group owner modifies member's message", "modify message", friends, groupDM(), newMessage(2, carol), alice, false},
+		{"former author outside the dm modifies message", "modify message", friends, directDM(), newMessage(1, mallory), mallory, false},
+
+		// reacting and pinning
+		{"participant reacts", "react", friends, directDM(), newMessage(1, bob), alice, true},
+		{"non participant reacts", "react", friends, directDM(), newMessage(1, bob), mallory, false},
+		{"non friend reacts", "react", strangers, directDM(), newMessage(1, bob), alice, false},
+		{"participant reacts to message of another dm", "react", friends, directDM(), newMessage(3, bob), alice, false},
+		{"group member reacts to system message", "react", fakeStore{}, groupDM(), systemMessage(2, alice), bob, true},
+		{"recipient reacts to pending request", "react", strangers, requestDM(data.RequestPending), newMessage(1, alice), bob, false},
+
+		// group membership
+		{"member leaves group", "remove self", friends, groupDM(), nil, bob, true},
+		{"non member leaves group", "remove self", friends, groupDM(), nil, mallory, false},
+		{"participant leaves one to one dm", "remove self", friends, directDM(), nil, alice, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(tt.store, tt.store)
+			got, err := actions[tt.action](p, tt.dm, tt.msg, tt.userID)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("%s by user %d: got %t, want %t", tt.action, tt.userID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanRemoveMember(t *testing.T) {
+	p := New(fakeStore{}, fakeStore{})
+
+	tests := []struct {
+		name     string
+		dm       *data.DM
+		userID   int
+		memberID int
+		want     bool
+	}{
+		{"owner removes member", groupDM(), alice, bob, true},
+		{"member removes member", groupDM(), bob, carol, false},
+		{"member removes owner", groupDM(), bob, alice, false},
+		{"non member removes member", groupDM(), mallory, bob, false},
+		{"non member removes owner", groupDM(), mallory, alice, false},
+		{"participant removes other from one to one dm", directDM(), alice, bob, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.CanRemoveMember(tt.dm, tt.userID, tt.memberID)
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNonParticipants runs every action against every kind of dm for a user who isn't a
+// participant, which must never be allowed whatever the relationship between the users
+func TestNonParticipants(t *testing.T) {
+	dms := map[string]*data.DM{
+		"direct":           directDM(),
+		"pending request":  requestDM(data.RequestPending),
+		"accepted request": requestDM(data.RequestAccepted),
+		"declined request": requestDM(data.RequestDeclined),
+		"group":            groupDM(),
+	}
+	store := fakeStore{friends: true, canRequest: true}
+
+	for dmName, dm := range dms {
+		for actionName, check := range actions {
+			t.Run(dmName+"/"+actionName, func(t *testing.T) {
+				p := New(store, store)
+				for _, m := range []*data.MessageResp{newMessage(dm.ID, alice), newMessage(dm.ID, mallory)} {
+					got, err := check(p, dm, m, mallory)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					if got {
+						t.Errorf("non participant was allowed to %s", actionName)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	errStore := errors.New("store failed")
+	store := fakeStore{err: errStore}
+
+	tests := []struct {
+		name   string
+		action string
+		dm     *data.DM
+		msg    *data.MessageResp
+	}{
+		{"post to direct dm", "post", directDM(), nil},
+		{"post to pending request", "post", requestDM(data.RequestPending), nil},
+		{"post to accepted request", "post", requestDM(data.RequestAccepted), nil},
+		{"modify message", "modify message", directDM(), newMessage(1, alice)},
+		{"react", "react", directDM(), newMessage(1, bob)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(store, store)
+			got, err := actions[tt.action](p, tt.dm, tt.msg, alice)
+			if !errors.Is(err, errStore) {
+				t.Errorf("got error %v, want %v", err, errStore)
+			}
+			if got {
+				t.Error("allowed despite the error")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package preview
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"192.0.0.1", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::7f00:1", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %t, want %t", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSafeControl(t *testing.T) {
+	tests := []struct {
+		network string
+		address string
+		allowed bool
+	}{
+		{"tcp4", "93.184.216.34:80", true},
+		{"tcp4", "93.184.216.34:443", true},
+		{"tcp6", "[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"tcp4", "93.184.216.34:8080", false},
+		{"tcp4", "93.184.216.34:22", false},
+		{"tcp4", "93.184.216.34:0", false},
+		{"tcp4", "127.0.0.1:80", false},
+		{"tcp4", "169.254.169.254:80", false},
+		{"tcp4", "10.0.0.1:443", false},
+		{"tcp6", "[::1]:443", false},
+		{"tcp6", "[fd00::1]:80", false},
+		{"tcp6", "[::ffff:192.168.0.1]:80", false},
+		{"udp4", "93.184.216.34:443", false},
+		{"unix", "/var/run/docker.sock", false},
+		{"tcp4", "example.com:80", false},
+	}
+
+	for _, tt := range tests {
+		err := safeControl(tt.network, tt.address, nil)
+		if tt.allowed && err != nil {
+			t.Errorf("%s %s: unexpected error: %v", tt.network, tt.address, err)
+		}
+		if !tt.allowed && !errors.Is(err, errBlockedAddress) {
+			t.Errorf("%s %s: got error %v, want an error wrapping errBlockedAddress", tt.network, tt.address, err)
+		}
+	}
+}
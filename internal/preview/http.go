@@ -0,0 +1,233 @@
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kickbu2towski/brb-api/internal/data"
+	"golang.org/x/net/html"
+)
+
+const (
+	maxRedirects  = 3
+	maxHTMLBytes  = 512 << 10
+	maxOEmbedSize = 64 << 10
+)
+
+// HTTPFetcher fetches OpenGraph and oEmbed metadata. it only connects to public
+// addresses on the standard http ports
+type HTTPFetcher struct {
+	client *http.Client
+}
+
+func NewHTTPFetcher(timeout time.Duration) *HTTPFetcher {
+	return newHTTPFetcher(timeout, safeControl)
+}
+
+// newHTTPFetcher creates the fetcher with control as the dialer's Control func, tests pass
+// their own to reach local servers
+func newHTTPFetcher(timeout time.Duration, control func(network, address string, c syscall.RawConn) error) *HTTPFetcher {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: control,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+
+	return &HTTPFetcher{client: client}
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) (*data.LinkPreview, error) {
+	res, err := f.get(ctx, rawURL, "text/html")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrNoPreview
+	}
+
+	pageURL := res.Request.URL
+	meta, oembedURL := parseHead(io.LimitReader(res.Body, maxHTMLBytes))
+
+	p := &data.LinkPreview{
+		URL:         rawURL,
+		Title:       first(meta["og:title"], meta["twitter:title"], meta["title"]),
+		Description: first(meta["og:description"], meta["twitter:description"], meta["description"]),
+		ImageURL:    resolve(pageURL, first(meta["og:image"], meta["twitter:image"])),
+		SiteName:    first(meta["og:site_name"], pageURL.Hostname()),
+	}
+
+	if oembedURL != "" {
+		oembed, err := f.fetchOEmbed(ctx, resolve(pageURL, oembedURL))
+		if err == nil {
+			p.Title = first(p.Title, oembed.Title)
+			p.ImageURL = first(p.ImageURL, resolve(pageURL, oembed.ThumbnailURL))
+			p.SiteName = first(oembed.ProviderName, p.SiteName)
+			p.AuthorName = oembed.AuthorName
+		}
+	}
+
+	if p.Title == "" && p.Description == "" && p.ImageURL == "" {
+		return nil, ErrNoPreview
+	}
+
+	return p, nil
+}
+
+func (f *HTTPFetcher) get(ctx context.Context, rawURL, accept string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "brb-link-preview/1.0")
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d fetching %s", res.StatusCode, u.Redacted())
+	}
+
+	return res, nil
+}
+
+type oembedResp struct {
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+func (f *HTTPFetcher) fetchOEmbed(ctx context.Context, rawURL string) (*oembedResp, error) {
+	res, err := f.get(ctx, rawURL, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var oembed oembedResp
+	err = json.NewDecoder(io.LimitReader(res.Body, maxOEmbedSize)).Decode(&oembed)
+	if err != nil {
+		return nil, err
+	}
+	return &oembed, nil
+}
+
+// parseHead collects the meta tags and the json oEmbed link of the document head
+func parseHead(r io.Reader) (map[string]string, string) {
+	meta := make(map[string]string)
+	var oembedURL string
+
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return meta, oembedURL
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if string(name) == "head" {
+				return meta, oembedURL
+			}
+			if string(name) == "title" {
+				inTitle = false
+			}
+		case html.TextToken:
+			if inTitle && meta["title"] == "" {
+				meta["title"] = strings.TrimSpace(string(z.Text()))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := make(map[string]string)
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				attrs[string(k)] = string(v)
+			}
+
+			switch string(name) {
+			case "body":
+				return meta, oembedURL
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta":
+				key := first(attrs["property"], attrs["name"])
+				if key != "" && meta[strings.ToLower(key)] == "" {
+					meta[strings.ToLower(key)] = strings.TrimSpace(attrs["content"])
+				}
+			case "link":
+				if attrs["rel"] == "alternate" && attrs["type"] == "application/json+oembed" && oembedURL == "" {
+					oembedURL = attrs["href"]
+				}
+			}
+		}
+	}
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// resolve resolves ref against the page URL, only http(s) results are kept
+func resolve(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,262 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseHead(t *testing.T) {
+	tests := []struct {
+		name   string
+		html   string
+		meta   map[string]string
+		oembed string
+	}{
+		{
+			"open graph",
+			`<html><head><meta property="og:title" content=" Title "><meta property="og:image" content="/a.png"></head></html>`,
+			map[string]string{"og:title": "Title", "og:image": "/a.png"},
+			"",
+		},
+		{
+			"name attributes and title",
+			`<head><title> Page </title><meta name="Description" content="About"></head>`,
+			map[string]string{"title": "Page", "description": "About"},
+			"",
+		},
+		{
+			"first value wins",
+			`<head><meta property="og:title" content="one"><meta property="og:title" content="two"></head>`,
+			map[string]string{"og:title": "one"},
+			"",
+		},
+		{
+			"oembed link",
+			`<head><link rel="alternate" type="application/json+oembed" href="/oembed?url=x"></head>`,
+			map[string]string{},
+			"/oembed?url=x",
+		},
+		{
+			"xml oembed link is ignored",
+			`<head><link rel="alternate" type="text/xml+oembed" href="/oembed.xml"></head>`,
+			map[string]string{},
+			"",
+		},
+		{
+			"stops at the end of the head",
+			`<head><meta property="og:title" content="head"></head><meta property="og:description" content="after">`,
+			map[string]string{"og:title": "head"},
+			"",
+		},
+		{
+			"stops at the body",
+			`<meta property="og:title" content="head"><body><meta property="og:description" content="body">`,
+			map[string]string{"og:title": "head"},
+			"",
+		},
+		{
+			"self closing tags",
+			`<head><meta property="og:title" content="x"/></head>`,
+			map[string]string{"og:title": "x"},
+			"",
+		},
+		{
+			"meta without key",
+			`<head><meta charset="utf-8"><meta content="orphan"></head>`,
+			map[string]string{},
+			"",
+		},
+		{
+			"not html",
+			`{"title": "json"}`,
+			map[string]string{},
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, oembed := parseHead(strings.NewReader(tt.html))
+			if len(meta) != len(tt.meta) {
+				t.Errorf("got meta %v, want %v", meta, tt.meta)
+			}
+			for k, v := range tt.meta {
+				if meta[k] != v {
+					t.Errorf("meta %s: got %q, want %q", k, meta[k], v)
+				}
+			}
+			if oembed != tt.oembed {
+				t.Errorf("got oembed url %q, want %q", oembed, tt.oembed)
+			}
+		})
+	}
+}
+
+// allowAll lets the fetcher reach the local test servers that safeControl blocks
+func allowAll(network, address string, _ syscall.RawConn) error {
+	return nil
+}
+
+func TestFetch(t *testing.T) {
+	mux := http.NewServeMux()
+	page := func(path, contentType, body string) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			fmt.Fprint(w, body)
+		})
+	}
+
+	page("/og", "text/html; charset=utf-8", `<head>
+		<meta property="og:title" content="Title">
+		<meta property="og:description" content="Description">
+		<meta property="og:image" content="/image.png">
+		<meta property="og:site_name" content="Site">
+	</head>`)
+	page("/twitter", "text/html", `<head>
+		<meta name="twitter:title" content="Tweet">
+		<meta name="twitter:image" content="javascript:alert(1)">
+	</head>`)
+	page("/oembed-page", "text/html", `<head>
+		<meta property="og:title" content="Video">
+		<link rel="alternate" type="application/json+oembed" href="/oembed.json">
+	</head>`)
+	page("/oembed.json", "application/json", `{"provider_name": "Provider", "author_name": "Author", "thumbnail_url": "/thumb.png"}`)
+	page("/empty", "text/html", `<head><title></title></head>`)
+	page("/json", "application/json", `{"title": "not a page"}`)
+
+	// the metadata is only within reach when the padding fits the html limit
+	page("/within-limit", "text/html", "<head><!--"+strings.Repeat("x", maxHTMLBytes-100)+`--><meta property="og:title" content="Found">`)
+	page("/over-limit", "text/html", "<head><!--"+strings.Repeat("x", maxHTMLBytes)+`--><meta property="og:title" content="Hidden">`)
+	page("/big-oembed-page", "text/html", `<head>
+		<meta property="og:title" content="Page">
+		<link rel="alternate" type="application/json+oembed" href="/big-oembed.json">
+	</head>`)
+	page("/big-oembed.json", "application/json", `{"padding": "`+strings.Repeat("x", maxOEmbedSize)+`", "author_name": "Hidden"}`)
+
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/og", http.StatusFound)
+	})
+	mux.HandleFunc("/redirect-scheme", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	f := newHTTPFetcher(2*time.Second, allowAll)
+
+	tests := []struct {
+		name        string
+		path        string
+		title       string
+		description string
+		imageURL    string
+		siteName    string
+		authorName  string
+		wantErr     bool
+		noPreview   bool
+	}{
+		{name: "open graph", path: "/og", title: "Title", description: "Description", imageURL: srv.URL + "/image.png", siteName: "Site"},
+		{name: "twitter tags without unsafe image", path: "/twitter", title: "Tweet", siteName: "127.0.0.1"},
+		{name: "oembed", path: "/oembed-page", title: "Video", imageURL: srv.URL + "/thumb.png", siteName: "Provider", authorName: "Author"},
+		{name: "redirect", path: "/redirect", title: "Title", description: "Description", imageURL: srv.URL + "/image.png", siteName: "Site"},
+		{name: "html within the size limit", path: "/within-limit", title: "Found", siteName: "127.0.0.1"},
+		{name: "html over the size limit", path: "/over-limit", wantErr: true, noPreview: true},
+		{name: "oembed over the size limit", path: "/big-oembed-page", title: "Page", siteName: "127.0.0.1"},
+		{name: "no metadata", path: "/empty", wantErr: true, noPreview: true},
+		{name: "not html", path: "/json", wantErr: true, noPreview: true},
+		{name: "not found", path: "/missing", wantErr: true},
+		{name: "redirect loop", path: "/loop", wantErr: true},
+		{name: "redirect to another scheme", path: "/redirect-scheme", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := f.Fetch(context.Background(), srv.URL+tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got preview %+v, want an error", p)
+				}
+				if tt.noPreview && !errors.Is(err, ErrNoPreview) {
+					t.Errorf("got error %v, want ErrNoPreview", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := []string{p.Title, p.Description, p.ImageURL, p.SiteName, p.AuthorName}
+			want := []string{tt.title, tt.description, tt.imageURL, tt.siteName, tt.authorName}
+			for i, field := range []string{"title", "description", "image url", "site name", "author name"} {
+				if got[i] != want[i] {
+					t.Errorf("%s: got %q, want %q", field, got[i], want[i])
+				}
+			}
+			if p.URL != srv.URL+tt.path {
+				t.Errorf("url: got %q, want %q", p.URL, srv.URL+tt.path)
+			}
+		})
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	f := newHTTPFetcher(100*time.Millisecond, allowAll)
+	start := time.Now()
+	_, err := f.Fetch(context.Background(), srv.URL)
+	if err == nil {
+		t.Fatal("got no error, want a timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("fetch took %s, want it to stop after the timeout", d)
+	}
+}
+
+func TestFetchUnsupportedScheme(t *testing.T) {
+	f := newHTTPFetcher(time.Second, allowAll)
+	for _, u := range []string{"file:///etc/passwd", "ftp://example.com", "gopher://example.com"} {
+		_, err := f.Fetch(context.Background(), u)
+		if err == nil {
+			t.Errorf("%s: got no error", u)
+		}
+	}
+}
+
+// TestFetchBlocksLocalServer checks the real fetcher refuses to connect to a server on
+// the loopback address, the way it would for an internal service
+func TestFetchBlocksLocalServer(t *testing.T) {
+	var hit bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+		fmt.Fprint(w, `<head><meta property="og:title" content="Internal"></head>`)
+	}))
+	defer srv.Close()
+
+	f := NewHTTPFetcher(time.Second)
+	_, err := f.Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("got error %v, want an error wrapping errBlockedAddress", err)
+	}
+	if hit {
+		t.Error("the request reached the server")
+	}
+}
@@ -0,0 +1,33 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/kickbu2towski/brb-api/internal/data"
+)
+
+var ErrNoPreview = errors.New("no preview metadata found")
+
+// Fetcher fetches the preview metadata of a URL
+type Fetcher interface {
+	Fetch(ctx context.Context, url string) (*data.LinkPreview, error)
+}
+
+var urlRx = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// FirstURL returns the first http(s) URL in the content, or an empty string
+func FirstURL(content string) string {
+	u := urlRx.FindString(content)
+	// trailing punctuation is more likely part of the sentence than the URL
+	for len(u) > 0 {
+		switch u[len(u)-1] {
+		case '.', ',', '!', '?', ')', ';', ':':
+			u = u[:len(u)-1]
+			continue
+		}
+		break
+	}
+	return u
+}
@@ -0,0 +1,31 @@
+package preview
+
+import "testing"
+
+func TestFirstURL(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"no links here", ""},
+		{"see https://example.com", "https://example.com"},
+		{"see http://example.com/a?b=c#d", "http://example.com/a?b=c#d"},
+		{"first https://a.com then https://b.com", "https://a.com"},
+		{"end of sentence https://example.com.", "https://example.com"},
+		{"(https://example.com/path)", "https://example.com/path"},
+		{"wow https://example.com!?", "https://example.com"},
+		{"list https://example.com, and more", "https://example.com"},
+		{`quoted "https://example.com" link`, "https://example.com"},
+		{"<https://example.com>", "https://example.com"},
+		{"ftp://example.com", ""},
+		{"javascript:alert(1)", ""},
+		{"mailto:a@example.com", ""},
+		{"https://", ""},
+	}
+
+	for _, tt := range tests {
+		if got := FirstURL(tt.content); got != tt.want {
+			t.Errorf("FirstURL(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
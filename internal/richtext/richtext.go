@@ -0,0 +1,353 @@
+package richtext
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type NodeType string
+
+const (
+	NodeText      NodeType = "text"
+	NodeBold      NodeType = "bold"
+	NodeItalic    NodeType = "italic"
+	NodeCode      NodeType = "code"
+	NodeCodeBlock NodeType = "code_block"
+	NodeLink      NodeType = "link"
+	NodeSpoiler   NodeType = "spoiler"
+	NodeEmoji     NodeType = "emoji"
+)
+
+// Node is a node of the parsed content. text and code nodes carry Text, link nodes carry
+// URL, emoji nodes carry their :name: as Text and the custom emoji's ID, and the other
+// nodes wrap their Children
+type Node struct {
+	Type     NodeType `json:"type"`
+	Text     string   `json:"text,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	Children []*Node  `json:"children,omitempty"`
+}
+
+// ErrDisallowed is wrapped by the errors returned for markup outside the supported subset
+var ErrDisallowed = errors.New("content contains unsupported markup")
+
+// maxDepth bounds how deeply formatting can be nested
+const maxDepth = 8
+
+var (
+	htmlTagRx     = regexp.MustCompile(`^</?[a-zA-Z][a-zA-Z0-9-]*(\s[^<>]*)?/?>`)
+	shortcodeRx   = regexp.MustCompile(`:([a-z0-9_]{2,32}):`)
+	allowedScheme = map[string]bool{"http": true, "https": true, "mailto": true}
+)
+
+// Parse parses the supported markdown subset: **bold**, *italic* or _italic_, `code`,
+// ```code blocks```, [links](https://example.com) and ||spoilers||. unterminated markup is
+// kept as text, while images, html and links to other schemes are rejected
+func Parse(src string) ([]*Node, error) {
+	return parseInline(src, 0, false)
+}
+
+// Text returns the content as a single text node, for content that isn't parsed
+func Text(s string) []*Node {
+	return []*Node{{Type: NodeText, Text: s}}
+}
+
+// PlainText renders the nodes as plain text without markup
+func PlainText(nodes []*Node) string {
+	var b strings.Builder
+	writePlainText(&b, nodes)
+	return b.String()
+}
+
+func writePlainText(b *strings.Builder, nodes []*Node) {
+	for _, n := range nodes {
+		b.WriteString(n.Text)
+		writePlainText(b, n.Children)
+	}
+}
+
+// EmojiNames returns the distinct names of the :name: shortcodes in the text of the nodes
+func EmojiNames(nodes []*Node) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	var walk func(nodes []*Node)
+	walk = func(nodes []*Node) {
+		for _, n := range nodes {
+			if n.Type == NodeText {
+				for _, m := range shortcodeRx.FindAllStringSubmatch(n.Text, -1) {
+					if !seen[m[1]] {
+						seen[m[1]] = true
+						names = append(names, m[1])
+					}
+				}
+			}
+			walk(n.Children)
+		}
+	}
+	walk(nodes)
+	return names
+}
+
+// ReplaceEmoji splits the :name: shortcodes of the names in emoji out of the text of the
+// nodes into emoji nodes with the mapped IDs. other shortcodes are kept as text
+func ReplaceEmoji(nodes []*Node, emoji map[string]string) []*Node {
+	replaced := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Type != NodeText {
+			if len(n.Children) > 0 {
+				n.Children = ReplaceEmoji(n.Children, emoji)
+			}
+			replaced = append(replaced, n)
+			continue
+		}
+
+		start := 0
+		for _, m := range shortcodeRx.FindAllStringSubmatchIndex(n.Text, -1) {
+			id, ok := emoji[n.Text[m[2]:m[3]]]
+			if !ok {
+				continue
+			}
+			if m[0] > start {
+				replaced = append(replaced, &Node{Type: NodeText, Text: n.Text[start:m[0]]})
+			}
+			replaced = append(replaced, &Node{Type: NodeEmoji, Text: n.Text[m[0]:m[1]], ID: id})
+			start = m[1]
+		}
+		if start < len(n.Text) {
+			replaced = append(replaced, &Node{Type: NodeText, Text: n.Text[start:]})
+		}
+	}
+	return replaced
+}
+
+func parseInline(s string, depth int, inLink bool) ([]*Node, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: formatting is nested too deeply", ErrDisallowed)
+	}
+
+	nodes := make([]*Node, 0)
+	c := newCloser(s)
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, &Node{Type: NodeText, Text: text.String()})
+			text.Reset()
+		}
+	}
+	wrap := func(t NodeType, inner string, inLink bool) error {
+		children, err := parseInline(inner, depth+1, inLink)
+		if err != nil {
+			return err
+		}
+		flush()
+		nodes = append(nodes, &Node{Type: t, Children: children})
+		return nil
+	}
+
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && isPunct(rest[1]):
+			text.WriteByte(rest[1])
+			i += 2
+			continue
+
+		case strings.HasPrefix(rest, "```"):
+			if end := c.index(i+3, "```") - i - 3; end >= 0 {
+				code := rest[3 : 3+end]
+				code = strings.TrimPrefix(code, "\n")
+				code = strings.TrimSuffix(code, "\n")
+				flush()
+				nodes = append(nodes, &Node{Type: NodeCodeBlock, Text: code})
+				i += 3 + end + 3
+				continue
+			}
+
+		case rest[0] == '`':
+			if end := c.index(i+1, "`") - i - 1; end > 0 {
+				flush()
+				nodes = append(nodes, &Node{Type: NodeCode, Text: rest[1 : 1+end]})
+				i += 1 + end + 1
+				continue
+			}
+
+		case strings.HasPrefix(rest, "||"):
+			if end := c.find(i+2, "||") - i; end > 2 {
+				err := wrap(NodeSpoiler, rest[2:end], inLink)
+				if err != nil {
+					return nil, err
+				}
+				i += end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**"):
+			if end := c.find(i+2, "**") - i; end > 2 {
+				err := wrap(NodeBold, rest[2:end], inLink)
+				if err != nil {
+					return nil, err
+				}
+				i += end + 2
+				continue
+			}
+
+		case rest[0] == '*' || rest[0] == '_':
+			delim := rest[:1]
+			end := c.find(i+1, delim) - i
+			// underscores inside words (snake_case) aren't formatting
+			if delim == "_" && (isWordBefore(s, i) || end > 0 && isWordAt(s, i+end+1)) {
+				end = -1
+			}
+			if end > 1 && !unicode.IsSpace(rune(rest[1])) {
+				err := wrap(NodeItalic, rest[1:end], inLink)
+				if err != nil {
+					return nil, err
+				}
+				i += end + 1
+				continue
+			}
+
+		case strings.HasPrefix(rest, "!["):
+			if _, _, _, ok := c.parseLink(i + 1); ok {
+				return nil, fmt.Errorf("%w: images are not supported", ErrDisallowed)
+			}
+
+		case rest[0] == '[' && !inLink:
+			if label, target, n, ok := c.parseLink(i); ok {
+				u, err := url.Parse(target)
+				if err != nil || !allowedScheme[strings.ToLower(u.Scheme)] {
+					return nil, fmt.Errorf("%w: links must use http, https or mailto", ErrDisallowed)
+				}
+				children, err := parseInline(label, depth+1, true)
+				if err != nil {
+					return nil, err
+				}
+				flush()
+				nodes = append(nodes, &Node{Type: NodeLink, URL: target, Children: children})
+				i += n
+				continue
+			}
+
+		case rest[0] == '<':
+			if htmlTagRx.MatchString(rest) {
+				return nil, fmt.Errorf("%w: html is not supported", ErrDisallowed)
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(rest)
+		text.WriteString(rest[:size])
+		i += size
+	}
+
+	flush()
+	return nodes, nil
+}
+
+// findClose returns the index in s of the delimiter closing the one before start, or -1.
+// escaped characters and code spans are skipped, and a single character delimiter doesn't
+// close on a doubled one
+func findClose(s string, start int, delim string) int {
+	for j := start; j < len(s); j++ {
+		switch {
+		case s[j] == '\\':
+			j++
+		case s[j] == '`':
+			if end := strings.IndexByte(s[j+1:], '`'); end >= 0 {
+				j += end + 1
+			}
+		case strings.HasPrefix(s[j:], delim):
+			if len(delim) == 1 && j+1 < len(s) && s[j+1] == delim[0] {
+				j++
+				continue
+			}
+			return j
+		}
+	}
+	return -1
+}
+
+// closer finds the delimiters closing the ones opened in s. the result of each search is
+// kept, so later openers of the same delimiter before the found closer, or after a failed
+// search, don't scan s again. this keeps parsing linear in the length of s
+type closer struct {
+	s    string
+	from map[string]int
+	at   map[string]int
+}
+
+func newCloser(s string) *closer {
+	return &closer{s: s, from: make(map[string]int), at: make(map[string]int)}
+}
+
+// find returns the index in s of the delimiter closing one opened before start, or -1
+func (c *closer) find(start int, delim string) int {
+	return c.cached("close"+delim, start, func() int {
+		return findClose(c.s, start, delim)
+	})
+}
+
+// index returns the index in s of the first sub at or after start, or -1
+func (c *closer) index(start int, sub string) int {
+	return c.cached("index"+sub, start, func() int {
+		if i := strings.Index(c.s[start:], sub); i >= 0 {
+			return start + i
+		}
+		return -1
+	})
+}
+
+func (c *closer) cached(key string, start int, search func() int) int {
+	from, ok := c.from[key]
+	at := c.at[key]
+	if ok && start >= from && (at < 0 || start <= at) {
+		return at
+	}
+	at = search()
+	c.from[key], c.at[key] = start, at
+	return at
+}
+
+// parseLink parses a [label](target) at index i of s and returns its length
+func (c *closer) parseLink(i int) (label, target string, n int, ok bool) {
+	s := c.s
+	if !strings.HasPrefix(s[i:], "[") {
+		return "", "", 0, false
+	}
+	end := c.find(i+1, "]")
+	if end < 0 || !strings.HasPrefix(s[end:], "](") {
+		return "", "", 0, false
+	}
+	paren := c.index(end+2, ")")
+	if paren < 0 {
+		return "", "", 0, false
+	}
+	target = strings.TrimSpace(s[end+2 : paren])
+	if target == "" || strings.ContainsAny(target, " \t\n") {
+		return "", "", 0, false
+	}
+	return s[i+1 : end], target, paren + 1 - i, true
+}
+
+func isPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("`*_|~<>[]()!", c) >= 0
+}
+
+func isWordBefore(s string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return i > 0 && isWord(r)
+}
+
+func isWordAt(s string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return i < len(s) && isWord(r)
+}
+
+func isWord(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,241 @@
+package richtext
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func text(s string) *Node {
+	return &Node{Type: NodeText, Text: s}
+}
+
+func wrapped(t NodeType, children ...*Node) *Node {
+	return &Node{Type: t, Children: children}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []*Node
+	}{
+		{"plain text", "hello", []*Node{text("hello")}},
+		{"bold", "**hi**", []*Node{wrapped(NodeBold, text("hi"))}},
+		{"italic with stars", "*hi*", []*Node{wrapped(NodeItalic, text("hi"))}},
+		{"italic with underscores", "_hi_", []*Node{wrapped(NodeItalic, text("hi"))}},
+		{"code", "`a*b*`", []*Node{{Type: NodeCode, Text: "a*b*"}}},
+		{"code block", "```\nx := 1\n```", []*Node{{Type: NodeCodeBlock, Text: "x := 1"}}},
+		{"spoiler", "||secret||", []*Node{wrapped(NodeSpoiler, text("secret"))}},
+		{"https link", "[site](https://example.com)", []*Node{{Type: NodeLink, URL: "https://example.com", Children: []*Node{text("site")}}}},
+		{"mailto link", "[mail](mailto:a@example.com)", []*Node{{Type: NodeLink, URL: "mailto:a@example.com", Children: []*Node{text("mail")}}}},
+		{"uppercase scheme", "[x](HTTPS://example.com)", []*Node{{Type: NodeLink, URL: "HTTPS://example.com", Children: []*Node{text("x")}}}},
+		{"nested formatting", "**a *b* c**", []*Node{wrapped(NodeBold, text("a "), wrapped(NodeItalic, text("b")), text(" c"))}},
+		{"every kind of nesting", "[**a ||b _c *d*_||**](https://example.com)", []*Node{{Type: NodeLink, URL: "https://example.com", Children: []*Node{
+			wrapped(NodeBold, text("a "), wrapped(NodeSpoiler, text("b "), wrapped(NodeItalic, text("c "), wrapped(NodeItalic, text("d"))))),
+		}}}},
+		{"snake_case word", "snake_case_word", []*Node{text("snake_case_word")}},
+		{"snake_case words", "a_b and c_d", []*Node{text("a_b and c_d")}},
+		{"underscore closing inside word", "_a_b", []*Node{text("_a_b")}},
+		{"escaped markup", `\*not italic\*`, []*Node{text("*not italic*")}},
+		{"unterminated bold", "**open", []*Node{text("**open")}},
+		{"unterminated link", "[label](https://example.com", []*Node{text("[label](https://example.com")}},
+		{"link with space in target", "[a](https://example.com/a b)", []*Node{text("[a](https://example.com/a b)")}},
+		{"less than is not html", "1 < 2 and 3 > 2", []*Node{text("1 < 2 and 3 > 2")}},
+		{"html in code", "`<script>`", []*Node{{Type: NodeCode, Text: "<script>"}}},
+		{"javascript in code", "`[x](javascript:alert(1))`", []*Node{{Type: NodeCode, Text: "[x](javascript:alert(1))"}}},
+		{"links aren't nested", "[[a](https://a.com)](https://b.com)", []*Node{
+			{Type: NodeLink, URL: "https://a.com", Children: []*Node{text("[a")}},
+			text("](https://b.com)"),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.src)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %s, want %s", dump(got), dump(tt.want))
+			}
+		})
+	}
+}
+
+func TestParseDisallowed(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"javascript link", "[x](javascript:alert(1))"},
+		{"uppercase javascript link", "[x](JavaScript:alert(1))"},
+		{"javascript link in bold", "**[x](javascript:alert(1))**"},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)"},
+		{"vbscript link", "[x](vbscript:msgbox)"},
+		{"relative link", "[x](/v1/users)"},
+		{"protocol relative link", "[x](//evil.example.com)"},
+		{"image", "![x](https://example.com/a.png)"},
+		{"script tag", "<script>alert(1)</script>"},
+		{"closing tag", "</div>"},
+		{"tag with attributes", `<img src=x onerror="alert(1)">`},
+		{"self closing tag", "<br/>"},
+		{"html in spoiler", "||<iframe src=x>||"},
+		{"html in link label", "[<b>x</b>](https://example.com)"},
+		{"html nested deeply", "[**a ||b _c *<b>*_||**](https://example.com)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := Parse(tt.src)
+			if !errors.Is(err, ErrDisallowed) {
+				t.Errorf("got %s and error %v, want an error wrapping ErrDisallowed", dump(nodes), err)
+			}
+		})
+	}
+}
+
+// TestParseDepth parses at a given depth directly, since a delimiter never nests in itself
+// and the supported markup alone can't reach maxDepth
+func TestParseDepth(t *testing.T) {
+	tests := []struct {
+		src     string
+		depth   int
+		allowed bool
+	}{
+		{"x", 0, true},
+		{"x", maxDepth, true},
+		{"x", maxDepth + 1, false},
+		{"**x**", maxDepth - 1, true},
+		{"**x**", maxDepth, false},
+		{"[**||x||**](https://example.com)", maxDepth - 3, true},
+		{"[**||x||**](https://example.com)", maxDepth - 2, false},
+	}
+
+	for _, tt := range tests {
+		_, err := parseInline(tt.src, tt.depth, false)
+		if tt.allowed && err != nil {
+			t.Errorf("%q at depth %d: unexpected error: %v", tt.src, tt.depth, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrDisallowed) {
+			t.Errorf("%q at depth %d: got error %v, want an error wrapping ErrDisallowed", tt.src, tt.depth, err)
+		}
+	}
+}
+
+// TestParseLinear guards against inputs that make every opening delimiter rescan the rest
+// of the content
+func TestParseLinear(t *testing.T) {
+	const n = 160 << 10
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"open brackets", strings.Repeat("[", n)},
+		{"open brackets with one close", strings.Repeat("[", n) + "]"},
+		{"links without target end", strings.Repeat("[a](", n/4)},
+		{"images without target end", strings.Repeat("![a](", n/5)},
+		{"stars", strings.Repeat("*", n)},
+		{"underscores", strings.Repeat("_a", n/2)},
+		{"bold openers", strings.Repeat("**a", n/3)},
+		{"spoiler openers", strings.Repeat("||", n/2) + "x"},
+		{"backticks", strings.Repeat("`", n+1)},
+		{"code block openers", strings.Repeat("```a", n/4)},
+		{"tags without end", strings.Repeat("<a ", n/3)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			Parse(tt.src)
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("parsing %d bytes took %s", len(tt.src), d)
+			}
+		})
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"**bold** and _italic_", "bold and italic"},
+		{"[site](https://example.com)", "site"},
+		{"||spoiler|| `code`", "spoiler code"},
+		{"snake_case", "snake_case"},
+	}
+
+	for _, tt := range tests {
+		nodes, err := Parse(tt.src)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.src, err)
+		}
+		if got := PlainText(nodes); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestReplaceEmoji(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []*Node
+		emoji map[string]string
+		want  []*Node
+	}{
+		{
+			"known shortcode",
+			[]*Node{text("hi :wave: there")},
+			map[string]string{"wave": "E1"},
+			[]*Node{text("hi "), {Type: NodeEmoji, Text: ":wave:", ID: "E1"}, text(" there")},
+		},
+		{
+			"unknown shortcode",
+			[]*Node{text("hi :nope:")},
+			map[string]string{"wave": "E1"},
+			[]*Node{text("hi :nope:")},
+		},
+		{
+			"shortcode in bold",
+			[]*Node{wrapped(NodeBold, text(":wave:"))},
+			map[string]string{"wave": "E1"},
+			[]*Node{wrapped(NodeBold, &Node{Type: NodeEmoji, Text: ":wave:", ID: "E1"})},
+		},
+		{
+			"shortcode in code",
+			[]*Node{{Type: NodeCode, Text: ":wave:"}},
+			map[string]string{"wave": "E1"},
+			[]*Node{{Type: NodeCode, Text: ":wave:"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ReplaceEmoji(tt.nodes, tt.emoji)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %s, want %s", dump(got), dump(tt.want))
+			}
+		})
+	}
+}
+
+func dump(nodes []*Node) string {
+	parts := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		s := string(n.Type)
+		if n.Text != "" {
+			s += "(" + n.Text + ")"
+		}
+		if n.URL != "" {
+			s += "<" + n.URL + ">"
+		}
+		if len(n.Children) > 0 {
+			s += "[" + dump(n.Children) + "]"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
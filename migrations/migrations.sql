@@ -46,3 +46,174 @@ CREATE TABLE IF NOT EXISTS reactions (
   user_id INTEGER REFERENCES users (id),
   message_id TEXT REFERENCES messages(id)
 );
+
+ALTER TABLE dms ADD COLUMN IF NOT EXISTS name TEXT;
+ALTER TABLE dms ADD COLUMN IF NOT EXISTS owner_id INTEGER REFERENCES users(id);
+ALTER TABLE dms ADD COLUMN IF NOT EXISTS is_group BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_system BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS messages_dm_id_created_at_id_idx ON messages (dm_id, created_at, id);
+
+-- generated from content, so edits keep the search index current
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+  GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED;
+CREATE INDEX IF NOT EXISTS messages_search_vector_idx ON messages USING GIN (search_vector);
+
+CREATE TABLE IF NOT EXISTS attachments (
+  id            TEXT PRIMARY KEY,
+  user_id       INTEGER NOT NULL REFERENCES users(id),
+  message_id    TEXT REFERENCES messages(id),
+  filename      TEXT NOT NULL,
+  mime_type     TEXT NOT NULL,
+  size          BIGINT NOT NULL,
+  storage_key   TEXT NOT NULL,
+  width         INTEGER,
+  height        INTEGER,
+  thumbnail_key TEXT,
+  created_at    TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS attachments_message_id_idx ON attachments (message_id);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS link_preview JSONB;
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+  id          SERIAL PRIMARY KEY,
+  message_id  TEXT NOT NULL REFERENCES messages(id),
+  content     TEXT NOT NULL,
+  edited_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS message_revisions_message_id_idx ON message_revisions (message_id, edited_at);
+
+CREATE INDEX IF NOT EXISTS messages_reply_to_id_idx ON messages (reply_to_id);
+
+CREATE TABLE IF NOT EXISTS pinned_messages (
+  message_id  TEXT PRIMARY KEY REFERENCES messages(id),
+  dm_id       INTEGER NOT NULL REFERENCES dms(id),
+  pinned_by   INTEGER NOT NULL REFERENCES users(id),
+  pinned_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS pinned_messages_dm_id_idx ON pinned_messages (dm_id, pinned_at);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_nonce TEXT;
+DROP INDEX IF EXISTS messages_user_id_client_nonce_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS messages_dm_id_user_id_client_nonce_idx ON messages (dm_id, user_id, client_nonce)
+  WHERE client_nonce IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+  id              TEXT PRIMARY KEY,
+  dm_id           INTEGER NOT NULL REFERENCES dms(id),
+  user_id         INTEGER NOT NULL REFERENCES users(id),
+  content         TEXT NOT NULL,
+  reply_to_id     TEXT,
+  attachment_ids  TEXT[] NOT NULL DEFAULT '{}',
+  send_at         TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+  created_at      TIMESTAMP(0) WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_messages_send_at_idx ON scheduled_messages (send_at);
+CREATE INDEX IF NOT EXISTS scheduled_messages_user_id_idx ON scheduled_messages (user_id, send_at);
+
+ALTER TABLE dms ADD COLUMN IF NOT EXISTS retention TEXT NOT NULL DEFAULT 'off';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP(0) WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS messages_expires_at_idx ON messages (expires_at) WHERE expires_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS message_mentions (
+  message_id    TEXT NOT NULL REFERENCES messages(id),
+  user_id       INTEGER NOT NULL REFERENCES users(id),
+  start_offset  INTEGER NOT NULL,
+  end_offset    INTEGER NOT NULL,
+  PRIMARY KEY (message_id, start_offset)
+);
+
+CREATE INDEX IF NOT EXISTS message_mentions_user_id_idx ON message_mentions (user_id);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_ast JSONB;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS plain_text TEXT;
+
+-- search the plain text rendering instead of the markup. the generated column is only
+-- recreated when it still indexes the raw content
+DO $$
+BEGIN
+  IF NOT EXISTS (
+    SELECT 1 FROM information_schema.columns
+    WHERE table_name = 'messages' AND column_name = 'search_vector'
+    AND generation_expression LIKE '%plain_text%'
+  ) THEN
+    DROP INDEX IF EXISTS messages_search_vector_idx;
+    ALTER TABLE messages DROP COLUMN IF EXISTS search_vector;
+    ALTER TABLE messages ADD COLUMN search_vector tsvector
+      GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(plain_text, content))) STORED;
+    CREATE INDEX messages_search_vector_idx ON messages USING GIN (search_vector);
+  END IF;
+END $$;
+
+-- the original message isn't a foreign key, forwards outlive it when it expires
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS forwarded_from_message_id TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS forwarded_from_dm_id INTEGER REFERENCES dms(id);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS forwarded_from_user_id INTEGER REFERENCES users(id);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS forwarded_from_created_at TIMESTAMP(0) WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS attachments_storage_key_idx ON attachments (storage_key);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS dm_policy TEXT NOT NULL DEFAULT 'everyone';
+
+ALTER TABLE dms ADD COLUMN IF NOT EXISTS request_status TEXT;
+ALTER TABLE dms ADD COLUMN IF NOT EXISTS requested_by INTEGER REFERENCES users(id);
+
+CREATE TABLE IF NOT EXISTS user_blocks (
+  blocker_id  INTEGER NOT NULL REFERENCES users(id),
+  blocked_id  INTEGER NOT NULL REFERENCES users(id),
+  PRIMARY KEY (blocker_id, blocked_id)
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP(0) WITH TIME ZONE;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS purged_at TIMESTAMP(0) WITH TIME ZONE;
+UPDATE messages SET deleted_at = created_at WHERE is_deleted AND deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS messages_deleted_at_idx ON messages (deleted_at) WHERE is_deleted AND purged_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS hidden_messages (
+  user_id     INTEGER NOT NULL REFERENCES users(id),
+  message_id  TEXT NOT NULL REFERENCES messages(id),
+  PRIMARY KEY (user_id, message_id)
+);
+
+-- keep the first of duplicated reactions before enforcing uniqueness
+DELETE FROM reactions a USING reactions b
+WHERE a.message_id = b.message_id AND a.user_id = b.user_id AND a.reaction = b.reaction AND a.id > b.id;
+CREATE UNIQUE INDEX IF NOT EXISTS reactions_message_id_user_id_reaction_idx ON reactions (message_id, user_id, reaction);
+
+CREATE TABLE IF NOT EXISTS custom_emoji (
+  id           TEXT PRIMARY KEY,
+  owner_id     INTEGER NOT NULL REFERENCES users(id),
+  name         TEXT NOT NULL,
+  mime_type    TEXT NOT NULL,
+  size         BIGINT NOT NULL,
+  width        INTEGER NOT NULL,
+  height       INTEGER NOT NULL,
+  animated     BOOLEAN NOT NULL DEFAULT FALSE,
+  storage_key  TEXT NOT NULL,
+  created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS custom_emoji_owner_id_name_idx ON custom_emoji (owner_id, name);
+
+CREATE TABLE IF NOT EXISTS exports (
+  id            TEXT PRIMARY KEY,
+  user_id       INTEGER NOT NULL REFERENCES users(id),
+  dm_id         INTEGER NOT NULL REFERENCES dms(id),
+  format        TEXT NOT NULL,
+  status        TEXT NOT NULL,
+  storage_key   TEXT NOT NULL,
+  created_at    TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+  completed_at  TIMESTAMP(0) WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS exports_created_at_idx ON exports (created_at);
+CREATE INDEX IF NOT EXISTS exports_pending_user_id_idx ON exports (user_id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS attachments_unlinked_created_at_idx ON attachments (created_at) WHERE message_id IS NULL;
+-- replies keep pointing at parents removed by retention, which are previewed as deleted
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_reply_to_id_fkey;